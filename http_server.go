@@ -1,199 +1,5543 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"log/slog"
+	"math/big"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// define the maximum number of concurrent requests
-const maxConcurrentRequests = 10
+// Command line flags
+var (
+	ipQuota          = flag.Int64("ip-quota", 0, "maximum bytes served to a single client IP per quota window (0 disables the quota)")
+	quotaWindow      = flag.Duration("quota-window", time.Hour, "length of the sliding window used by -ip-quota")
+	proxyProtocol    = flag.Bool("proxy-protocol", false, "require a PROXY protocol v1 header on every connection and use the client address it carries")
+	network          = flag.String("network", "tcp", "network to listen on: tcp, tcp4 or tcp6")
+	bindRetries      = flag.Int("bind-retries", 0, "how many times to retry binding the port before giving up")
+	bindDelay        = flag.Duration("bind-retry-delay", time.Second, "pause between bind retries")
+	reusePort        = flag.Bool("reuseport", false, "set SO_REUSEPORT so several server processes can share the port")
+	sniffText        = flag.Bool("sniff-text", false, "refine text/plain to JSON or CSV by peeking at the start of the file")
+	sitemapPath      = flag.String("sitemap-path", "", "URL path that serves a generated XML sitemap of the .html files, e.g. /sitemap.xml (empty disables it)")
+	sitemapTTL       = flag.Duration("sitemap-ttl", 5*time.Minute, "how long a generated sitemap is reused before the tree is walked again")
+	baseURL          = flag.String("base-url", "", "absolute site URL used for sitemap entries, e.g. https://example.com")
+	acmeWebroot      = flag.String("acme-webroot", "", "directory holding ACME HTTP-01 challenge files, as passed to certbot --webroot -w (empty disables it)")
+	acmePath         = flag.String("acme-path", "/.well-known/acme-challenge/", "URL prefix of ACME HTTP-01 challenges")
+	maxUploads       = flag.Int("max-uploads", 0, "maximum number of uploads written at the same time, extra uploads get 503 (0 means no separate limit)")
+	requireLength    = flag.Bool("require-content-length", false, "reject uploads without Content-Length or chunked encoding with 411 Length Required")
+	responseDelay    = flag.Duration("delay", 0, "artificial delay before every response, for testing slow servers")
+	allowDelay       = flag.Bool("allow-delay-param", false, "let clients request a delay with a ?delay=<duration> query parameter")
+	uploadsDir       = flag.String("uploads-dir", "", "directory of untrusted uploads, served with a sandboxing CSP and HTML/SVG forced to download (empty disables it)")
+	uploadsCSP       = flag.String("uploads-csp", "sandbox", "Content-Security-Policy sent with files from -uploads-dir")
+	maxPathDepth     = flag.Int("max-path-depth", 32, "maximum number of segments in a request path, deeper paths get 400 (0 disables the check)")
+	healthPath       = flag.String("health-path", "", "URL path of the health check endpoint, e.g. /healthz (empty disables it)")
+	healthMinFree    = flag.Uint64("health-min-free", 10<<20, "free disk bytes below which the health check fails")
+	rootCheck        = flag.Duration("root-check-interval", 5*time.Second, "how often to check that the document root still exists")
+	noNosniff        = flag.Bool("no-nosniff", false, "do not send X-Content-Type-Options: nosniff with served files")
+	uploadMode       = flag.String("upload-mode", "path", "where POST bodies are stored: path (the request path) or spool (a unique name in -spool-dir)")
+	spoolDir         = flag.String("spool-dir", "spool", "directory for uploads in -upload-mode spool")
+	minUploadRate    = flag.Int64("min-upload-rate", 0, "minimum average upload rate in bytes per second, slower uploads are cut off (0 disables the check)")
+	uploadGrace      = flag.Duration("upload-grace", 10*time.Second, "time an upload gets on top of what -min-upload-rate allows")
+	statsPath        = flag.String("stats-path", "", "URL path of the JSON statistics endpoint, e.g. /stats (empty disables it)")
+	statsMaxPaths    = flag.Int("stats-max-paths", 1000, "number of distinct paths counted individually, further paths are counted as \"other\"")
+	backupDir        = flag.String("backup-dir", "", "directory that receives a synchronous copy of every upload except resumable Content-Range chunks (empty disables it)")
+	backupRequired   = flag.Bool("backup-required", false, "fail uploads whose backup copy cannot be written instead of only logging a warning")
+	memLimit         = flag.Uint64("mem-limit", 0, "heap size in bytes above which fewer connections are admitted (0 disables the check)")
+	languages        = flag.String("languages", "", "comma-separated language tags for Accept-Language negotiation of name.<lang>.html variants, e.g. en,fr (empty disables it)")
+	slowLog          = flag.Duration("slow-log-threshold", 0, "log requests that take longer than this as slow (0 disables slow request logging)")
+	suggest404       = flag.Bool("suggest-404", false, "list similarly named files from the same directory in 404 pages")
+	suggestMaxDir    = flag.Int("suggest-max-entries", 1000, "directories with more entries than this are not scanned for -suggest-404")
+	allowArchive     = flag.Bool("allow-archive", false, "serve a directory as a tar.gz download when requested with ?archive=tar.gz")
+	keepAliveTimeout = flag.Duration("keepalive-timeout", 5*time.Second, "how long an idle persistent connection waits for its next request (0 closes after every response)")
+	etagMode         = flag.String("etag", "mtime", "how file ETags are computed: mtime (size and modification time), content (SHA-256 of the file) or off")
+	gzipEnabled      = flag.Bool("gzip", true, "compress text responses for clients that send Accept-Encoding: gzip")
+	gzipMinSize      = flag.Int64("gzip-min-size", 1024, "smallest file in bytes that -gzip compresses")
+	listings         = flag.Bool("listings", true, "list the contents of directories that have no index.html")
+	docRoot          = flag.String("root", "", "directory to serve (empty serves the working directory)")
+	maxConnections   = flag.Int("max-connections", 10, "maximum number of connections served concurrently")
+	configFile       = flag.String("config", "", "TOML file with settings for any flag, the port and a [mime] table of extra extensions")
+	tlsCert          = flag.String("tls-cert", "", "PEM certificate (chain) for the HTTPS listener; with -tls-key enables it")
+	tlsKey           = flag.String("tls-key", "", "PEM private key for -tls-cert")
+	tlsPort          = flag.Int("tls-port", 8443, "port of the HTTPS listener, served next to the plain HTTP port")
+	http2Enabled     = flag.Bool("http2", true, "offer HTTP/2 on the HTTPS listener")
+	accessLogPath    = flag.String("access-log", "", "file that receives one Common Log Format line per request, \"-\" for stdout (empty disables it)")
+	logFormat        = flag.String("log-format", "text", "format of the server log: text or json")
+	logLevel         = flag.String("log-level", "info", "least severe server log messages written: debug, info, warn or error")
+	logFile          = flag.String("log-file", "", "file for the server log instead of stderr, rotated like -access-log")
+	logMaxSize       = flag.Int64("log-max-size", 0, "rotate -log-file and -access-log once they reach this many bytes (0 disables it)")
+	logMaxAge        = flag.Duration("log-max-age", 0, "rotate -log-file and -access-log once they are this old, e.g. 24h (0 disables it)")
+	logMaxBackups    = flag.Int("log-max-backups", 5, "rotated log files kept per log, the oldest are deleted")
+	logCompress      = flag.Bool("log-compress", false, "gzip rotated log files")
+	vhosts           = flag.String("vhosts", "", "name-based virtual hosts as host=dir pairs separated by commas; other hosts get the default root")
+	strictHost       = flag.Bool("strict-host", false, "answer requests for hosts not in -vhosts (or not matching the TLS server name) with 421 Misdirected Request instead of the default root")
+	errorPagesFlag   = flag.String("error-pages", "", "custom error pages as code=file pairs separated by commas, e.g. 404=errors/404.html")
+	mimeTypesFile    = flag.String("mime-types", "", "Apache-style mime.types file adding to or overriding the built-in extension table")
+	allowDelete      = flag.Bool("allow-delete", false, "accept DELETE requests that remove files (inside -uploads-dir when it is set)")
+	htpasswdFile     = flag.String("htpasswd", "", "htpasswd file of users allowed through HTTP Basic authentication (empty disables authentication)")
+	authPaths        = flag.String("auth-paths", "/", "URL path prefixes, separated by commas, that require -htpasswd authentication")
+	authRealm        = flag.String("auth-realm", "Restricted", "realm sent in the Basic authentication challenge")
+	jwtKeyFile       = flag.String("jwt-key", "", "key that POST, PUT and DELETE bearer tokens must be signed with: a PEM RSA public key (RS256) or a file holding an HS256 secret (empty disables it)")
+	rateLimit        = flag.Float64("rate-limit", 0, "average requests per second allowed from a single client IP (0 disables rate limiting)")
+	rateBurst        = flag.Int("rate-burst", 10, "requests a client IP may make at once before -rate-limit applies")
+	allowCIDRs       = flag.String("allow-cidrs", "", "client IP ranges (CIDRs or addresses, separated by commas) allowed to connect; empty allows all not denied")
+	denyCIDRs        = flag.String("deny-cidrs", "", "client IP ranges (CIDRs or addresses, separated by commas) refused even if allowed")
+	aclDrop          = flag.Bool("acl-drop", false, "close connections refused by -allow-cidrs/-deny-cidrs without answering 403")
+	headerTimeout    = flag.Duration("header-timeout", 10*time.Second, "time a client has to send the request line and headers (0 disables it)")
+	bodyTimeout      = flag.Duration("body-timeout", 0, "time a client has to send a request body (0 disables it)")
+	writeTimeout     = flag.Duration("write-timeout", 0, "time allowed for writing a whole response (0 disables it)")
+	maxBodySize      = flag.Int64("max-body-size", 0, "largest request body accepted for an upload, in bytes (0 means unlimited)")
+	corsFlag         = flag.String("cors", "", "cross-origin access as prefix=origins pairs separated by commas, origins separated by spaces or *, e.g. /api=https://app.example")
+	corsHeaders      = flag.String("cors-headers", "", "request headers allowed in cross-origin requests (empty allows whatever a preflight asks for)")
+	corsMaxAge       = flag.Duration("cors-max-age", 10*time.Minute, "how long browsers may cache a CORS preflight answer")
+	securityHeaders  = flag.Bool("security-headers", false, "send X-Content-Type-Options, X-Frame-Options and Referrer-Policy (and -csp, -hsts-max-age) with every response")
+	frameOptions     = flag.String("frame-options", "DENY", "X-Frame-Options sent with -security-headers")
+	referrerPolicy   = flag.String("referrer-policy", "strict-origin-when-cross-origin", "Referrer-Policy sent with -security-headers")
+	cspPolicy        = flag.String("csp", "", "Content-Security-Policy sent with -security-headers (empty sends none)")
+	hstsMaxAge       = flag.Duration("hsts-max-age", 0, "Strict-Transport-Security max-age sent over HTTPS with -security-headers (0 sends none)")
+	acceptQueue      = flag.Int("accept-queue", 0, "connections that may wait up to -queue-timeout for a free slot when all -max-connections are busy, more get 503 at once (0 makes the accept loop wait for a slot instead)")
+	queueTimeout     = flag.Duration("queue-timeout", 5*time.Second, "how long a connection waits in -accept-queue before it gets 503")
+	cacheSize        = flag.Int64("cache-size", 0, "bytes of small files kept in memory to serve repeated GETs without reading the disk (0 disables the cache)")
+	cacheMaxFile     = flag.Int64("cache-max-file", 256<<10, "largest file, in bytes, that -cache-size keeps")
+	precompressed    = flag.Bool("precompressed", false, "serve name.br or name.gz next to a file, when the client accepts that encoding, instead of the file")
+	spaFallback      = flag.Bool("spa", false, "answer GETs for missing paths without an extension with the root index.html, for single-page apps")
+	rewriteRules     = flag.String("rewrite-rules", "", "file of \"regex replacement [redirect|permanent]\" lines rewriting request paths before they are resolved")
+	redirectsFile    = flag.String("redirects", "", "file of \"path target [status]\" lines redirecting exact paths, or prefixes ending in /*, before files are served")
+	aliasesFlag      = flag.String("aliases", "", "URL prefixes served from other directories as prefix=dir[:rw][:list|:nolist] separated by commas; aliases are read-only unless :rw")
+	maxFormFiles     = flag.Int("max-form-files", 100, "most files accepted in one multipart/form-data upload")
+	shutdownTimeout  = flag.Duration("shutdown-timeout", 10*time.Second, "how long a connection waiting for a request gets after SIGINT or SIGTERM to send one before it is closed")
+	drainTimeout     = flag.Duration("drain-timeout", time.Minute, "how long SIGINT or SIGTERM waits for the requests in flight to finish before the server exits")
+	preload          = flag.String("preload", "", "comma-separated files or globs, relative to the document root, read into the -cache-size cache at startup")
+	listingCacheTTL  = flag.Duration("listing-cache-ttl", 0, "how long a generated directory listing is reused, unless the directory changes first (0 regenerates every time)")
+	connMaxRequests  = flag.Int("conn-max-requests", 0, "requests served on one connection before it is closed (0 for no limit)")
+	connMaxBytes     = flag.Int64("conn-max-bytes", 0, "bytes read from one connection, over all its requests, after which it is closed (0 for no limit)")
+	gzipMinVersion   = flag.String("gzip-min-version", "1.1", "lowest HTTP version that gets compressed responses, e.g. 1.1 keeps them from HTTP/1.0 clients")
+	gzipDenyAgents   = flag.String("gzip-deny-agents", "", "comma-separated User-Agent substrings (case-insensitive) of clients never sent compressed responses")
+	clientCA         = flag.String("client-ca", "", "PEM bundle of CAs that HTTPS client certificates are verified against (empty disables client certificates)")
+	clientAuthMode   = flag.String("client-auth-mode", "require-and-verify", "with -client-ca: require-and-verify, verify-if-given, require-any or request")
+	keepAliveMaxBody = flag.Int64("keepalive-max-response", 0, "responses with a body larger than this many bytes close the connection afterwards, so big downloads free their slot (0 always honours the client)")
+	tlsSelfSigned    = flag.Bool("tls-self-signed", false, "serve HTTPS with a self-signed certificate for localhost generated at startup, for development only")
+	rootFlag         = flag.String("root-behavior", "index", "response for \"/\": index, redirect=[301:]<url> or status=<code>")
+)
+
+// startTime is when the server started, for the uptime in health reports
+var startTime = time.Now()
+
+// activeConnections counts the connections currently being handled
+var activeConnections atomic.Int64
+
+// rootDir is the absolute path of the document root
+var rootDir string
+
+// rootAvailable is false while the document root is missing and requests get 503
+var rootAvailable atomic.Bool
+
+// quota tracks bytes served per client IP, nil when -ip-quota is disabled
+var quota *bandwidthQuota
+
+// limiter tracks request rates per client IP, nil when -rate-limit is disabled
+var limiter *rateLimiter
+
+// fileCache keeps small files in memory, nil when -cache-size is disabled
+var fileCache *contentCache
 
-// Supported MIME types
+// uploadSem limits concurrent uploads, nil when -max-uploads is disabled
+var uploadSem chan struct{}
+
+// connectionLimit is the number of connections currently admitted; -mem-limit
+// lowers it below -max-connections while the heap is too large
+var connectionLimit atomic.Int64
+
+// queuedConnections counts the connections waiting in -accept-queue, and
+// rejectedConnections those turned away with 503
+var queuedConnections, rejectedConnections atomic.Int64
+
+// pathHits counts GET requests per normalized path
+var pathHits = &hitCounter{hits: make(map[string]int64)}
+
+// rootConfig is the parsed -root-behavior
+var rootConfig rootBehavior
+
+// Supported MIME types, by lower-case extension
 var mimeTypes = map[string]string{
-	".html": "text/html",
-	".txt":  "text/plain",
-	".gif":  "image/gif",
-	".jpeg": "image/jpeg",
-	".jpg":  "image/jpeg",
-	".css":  "text/css",
+	".html":  "text/html",
+	".htm":   "text/html",
+	".txt":   "text/plain",
+	".css":   "text/css",
+	".csv":   "text/csv",
+	".md":    "text/markdown",
+	".xml":   "text/xml",
+	".js":    "text/javascript",
+	".mjs":   "text/javascript",
+	".json":  "application/json",
+	".map":   "application/json",
+	".pdf":   "application/pdf",
+	".wasm":  "application/wasm",
+	".zip":   "application/zip",
+	".gz":    "application/gzip",
+	".tar":   "application/x-tar",
+	".gif":   "image/gif",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".png":   "image/png",
+	".webp":  "image/webp",
+	".avif":  "image/avif",
+	".svg":   "image/svg+xml",
+	".ico":   "image/vnd.microsoft.icon",
+	".bmp":   "image/bmp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".mp3":   "audio/mpeg",
+	".ogg":   "audio/ogg",
+	".wav":   "audio/wav",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
 }
 
+// configMimeTypes holds the [mime] table of the config file, applied after
+// -mime-types so that it wins
+var configMimeTypes = make(map[string]string)
+
+// defaultMimeType is used for files whose type is neither known from the
+// extension nor recognised from their first bytes
+const defaultMimeType = "application/octet-stream"
+
 func main() {
-	// step 1: Check and get command line argument (port)
-	if len(os.Args) != 2 {
-		log.Fatalf("Usage: %s <port>", os.Args[0])
+	// step 1: Check and get command line arguments (flags and port)
+	flag.Parse()
+	applyEnv()
+	configPort := ""
+	if *configFile != "" {
+		var err error
+		if configPort, err = applyConfigFile(*configFile); err != nil {
+			fatalf("Invalid config file %v", err)
+		}
 	}
-	port := os.Args[1]
-	if _, err := strconv.Atoi(port); err != nil {
-		log.Fatalf("Invalid port: %s", port)
+	if err := setupLogging(); err != nil {
+		fatalf("%v", err)
+	}
+	if *mimeTypesFile != "" {
+		if err := loadMimeTypes(*mimeTypesFile); err != nil {
+			fatalf("Invalid -mime-types %v", err)
+		}
+	}
+	for ext, contentType := range configMimeTypes {
+		mimeTypes[ext] = contentType
+	}
+	port := flag.Arg(0)
+	configSource["port"] = "flag"
+	if flag.NArg() == 0 {
+		port = os.Getenv(envPrefix + "PORT")
+		configSource["port"] = "env"
+		if port == "" && configPort != "" {
+			port = configPort
+			configSource["port"] = "config"
+		}
+	}
+	if flag.NArg() > 1 || port == "" {
+		fatalf("Usage: %s [flags] <port>", os.Args[0])
+	}
+	_, err := strconv.Atoi(port)
+	if err != nil {
+		fatalf("Invalid port: %s", port)
 	}
 	address := ":" + port
-	log.Printf("Server will start on %s...", address)
+	if !validNetwork(*network) {
+		fatalf("Invalid network %q: must be tcp, tcp4 or tcp6", *network)
+	}
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *tlsSelfSigned {
+		if *tlsSelfSigned && (*tlsCert != "" || *tlsKey != "") {
+			fatalf("-tls-self-signed cannot be combined with -tls-cert and -tls-key")
+		}
+		if !*tlsSelfSigned && (*tlsCert == "" || *tlsKey == "") {
+			fatalf("-tls-cert and -tls-key must be given together")
+		}
+		if *proxyProtocol {
+			fatalf("-proxy-protocol is not supported with the HTTPS listener")
+		}
+		var cert tls.Certificate
+		if *tlsSelfSigned {
+			cert, err = selfSignedCertificate()
+			if err != nil {
+				fatalf("Failed to generate a self-signed certificate: %v", err)
+			}
+			warnf("Serving HTTPS with a self-signed certificate for %s: clients will not trust it, do not use it in production",
+				strings.Join(append(cert.Leaf.DNSNames, ipStrings(cert.Leaf.IPAddresses)...), ", "))
+		} else if cert, err = tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			fatalf("Failed to load TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if *http2Enabled {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		if *clientCA != "" {
+			if err := setClientAuth(tlsConfig, *clientCA, *clientAuthMode); err != nil {
+				fatalf("Invalid client certificate settings: %v", err)
+			}
+		}
+	} else if *clientCA != "" {
+		fatalf("-client-ca requires the HTTPS listener (-tls-cert and -tls-key)")
+	}
+	if *accessLogPath != "" {
+		if accessLog, err = openAccessLog(*accessLogPath); err != nil {
+			fatalf("Failed to open access log: %v", err)
+		}
+	}
+	if *maxConnections < 1 {
+		fatalf("Invalid -max-connections %d: must be at least 1", *maxConnections)
+	}
+	if *acceptQueue < 0 {
+		fatalf("Invalid -accept-queue %d: must not be negative", *acceptQueue)
+	}
+	infof("Server will start on %s...", address)
+
+	// Virtual host roots are relative to where the server was started
+	if vhostRoots, err = parseVhosts(*vhosts); err != nil {
+		fatalf("Invalid -vhosts: %v", err)
+	}
+	if *strictHost && len(vhostRoots) == 0 {
+		fatalf("-strict-host requires -vhosts")
+	}
+	if aliases, err = parseAliases(*aliasesFlag); err != nil {
+		fatalf("Invalid -aliases: %v", err)
+	}
+	if errorPages, err = parseErrorPages(*errorPagesFlag); err != nil {
+		fatalf("Invalid -error-pages: %v", err)
+	}
+	if *htpasswdFile != "" {
+		if htpasswdUsers, err = loadHtpasswd(*htpasswdFile); err != nil {
+			fatalf("Invalid -htpasswd: %v", err)
+		}
+	}
+	if *redirectsFile != "" {
+		if redirects, err = loadRedirects(*redirectsFile); err != nil {
+			fatalf("Invalid -redirects: %v", err)
+		}
+	}
+	if *rewriteRules != "" {
+		if rewrites, err = loadRewriteRules(*rewriteRules); err != nil {
+			fatalf("Invalid -rewrite-rules: %v", err)
+		}
+	}
+	if corsRules, err = parseCORS(*corsFlag); err != nil {
+		fatalf("Invalid -cors: %v", err)
+	}
+	if *corsMaxAge < 0 {
+		fatalf("Invalid -cors-max-age %s: must not be negative", *corsMaxAge)
+	}
+	if allowNets, err = parseCIDRs(*allowCIDRs); err != nil {
+		fatalf("Invalid -allow-cidrs: %v", err)
+	}
+	if denyNets, err = parseCIDRs(*denyCIDRs); err != nil {
+		fatalf("Invalid -deny-cidrs: %v", err)
+	}
+	if *jwtKeyFile != "" {
+		if err := loadJWTKey(*jwtKeyFile); err != nil {
+			fatalf("Invalid -jwt-key: %v", err)
+		}
+	}
+
+	// Serve -root instead of the working directory. Directories in other flags
+	// that may lie outside it are relative to where the server was started
+	if *docRoot != "" {
+		for _, dir := range []*string{acmeWebroot, backupDir} {
+			if *dir == "" {
+				continue
+			}
+			if *dir, err = filepath.Abs(*dir); err != nil {
+				fatalf("Failed to resolve %s: %v", *dir, err)
+			}
+		}
+		if err := os.Chdir(*docRoot); err != nil {
+			fatalf("Failed to enter document root: %v", err)
+		}
+	}
+
+	if *ipQuota > 0 {
+		if *quotaWindow <= 0 {
+			fatalf("Invalid quota window: %s", *quotaWindow)
+		}
+		quota = newBandwidthQuota(*ipQuota, *quotaWindow)
+		go quota.cleanupLoop()
+	}
+	if *cacheSize > 0 {
+		fileCache = newContentCache(*cacheSize)
+	}
+	if *rateLimit > 0 {
+		if *rateBurst < 1 {
+			fatalf("Invalid -rate-burst %d: must be at least 1", *rateBurst)
+		}
+		limiter = newRateLimiter(*rateLimit, *rateBurst)
+		go limiter.cleanupLoop()
+	}
+	if *acmeWebroot != "" {
+		if !strings.HasPrefix(*acmePath, "/") || !strings.HasSuffix(*acmePath, "/") {
+			fatalf("-acme-path must start and end with /: %s", *acmePath)
+		}
+	}
+	if *maxUploads > 0 {
+		uploadSem = make(chan struct{}, *maxUploads)
+	}
+	switch *uploadMode {
+	case "path":
+	case "spool":
+		if !filepath.IsLocal(*spoolDir) {
+			fatalf("-spool-dir must be a relative path inside the served directory: %s", *spoolDir)
+		}
+		if err := os.MkdirAll(*spoolDir, 0755); err != nil {
+			fatalf("Failed to create spool directory %s: %v", *spoolDir, err)
+		}
+	default:
+		fatalf("Invalid -upload-mode %q: must be path or spool", *uploadMode)
+	}
+	if rootConfig, err = parseRootBehavior(*rootFlag); err != nil {
+		fatalf("Invalid -root-behavior %q: %v", *rootFlag, err)
+	}
+	if *etagMode != "mtime" && *etagMode != "content" && *etagMode != "off" {
+		fatalf("Invalid -etag %q: must be mtime, content or off", *etagMode)
+	}
+	var ok bool
+	if gzipMajor, gzipMinor, ok = http.ParseHTTPVersion("HTTP/" + *gzipMinVersion); !ok {
+		fatalf("Invalid -gzip-min-version %q: must be like 1.1", *gzipMinVersion)
+	}
+	for _, agent := range strings.Split(*gzipDenyAgents, ",") {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			gzipDeniedAgents = append(gzipDeniedAgents, strings.ToLower(agent))
+		}
+	}
+	if *sitemapPath != "" {
+		if *baseURL == "" {
+			fatalf("-sitemap-path requires -base-url")
+		}
+		if _, err := url.ParseRequestURI(*baseURL); err != nil {
+			fatalf("Invalid base URL %s: %v", *baseURL, err)
+		}
+	}
+	if rootDir, err = os.Getwd(); err != nil {
+		fatalf("Failed to get the document root: %v", err)
+	}
+	rootAvailable.Store(true)
+	if *rootCheck > 0 {
+		go watchRoot(*rootCheck)
+	}
+	logConfig(address)
+	if *preload != "" {
+		if fileCache == nil {
+			fatalf("-preload requires -cache-size")
+		}
+		preloadCache(*preload)
+	}
 
-	// step 2: Listen on the port
-	listener, err := net.Listen("tcp", address)
+	// step 2: Listen on the port, retrying while an old process may still hold it
+	listener, err := listen(address)
+	for attempt := 1; err != nil && attempt <= *bindRetries; attempt++ {
+		warnf("Failed to listen on %s: %v (retry %d/%d in %s)", address, err, attempt, *bindRetries, *bindDelay)
+		time.Sleep(*bindDelay)
+		listener, err = listen(address)
+	}
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", address, err)
+		fatalf("Failed to listen on %s: %v", address, err)
 	}
 	defer listener.Close()
 
+	// The HTTPS listener shares the plain one's connection slots
+	var tlsListener net.Listener
+	if tlsConfig != nil {
+		tlsAddress := ":" + strconv.Itoa(*tlsPort)
+		raw, err := listen(tlsAddress)
+		if err != nil {
+			fatalf("Failed to listen on %s: %v", tlsAddress, err)
+		}
+		tlsListener = tls.NewListener(raw, tlsConfig)
+		defer tlsListener.Close()
+		infof("Serving HTTPS on %s", tlsAddress)
+		if *http2Enabled {
+			h2Server.IdleTimeout = *keepAliveTimeout
+			h2Server.ReadHeaderTimeout = *headerTimeout
+			h2Server.WriteTimeout = *writeTimeout
+			go h2Server.Serve(h2Listener)
+		}
+	}
+
 	// step 3: Limit concurrent requests
-	sem := make(chan struct{}, maxConcurrentRequests)
+	sem := make(chan struct{}, *maxConnections)
+	connectionLimit.Store(int64(*maxConnections))
+	if *memLimit > 0 {
+		go watchMemory(*memLimit)
+	}
+
+	// Stop accepting on SIGINT or SIGTERM and let the requests in flight finish
+	go awaitShutdown(listener, tlsListener)
+
+	if tlsListener != nil {
+		go acceptConnections(tlsListener, sem)
+	}
+	acceptConnections(listener, sem)
+	drainConnections(*shutdownTimeout, *drainTimeout)
+}
+
+// shutdown is closed once the server has been asked to stop
+var shutdown = make(chan struct{})
+
+// shuttingDown reports whether the server has been asked to stop
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitShutdown waits for a shutdown signal, then closes the listeners so the
+// accept loops return
+func awaitShutdown(listeners ...net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	sig := <-signals
+	infof("Received %s, shutting down", sig)
+	close(shutdown)
+	for _, listener := range listeners {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+	if *http2Enabled {
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		h2Server.Shutdown(ctx)
+	}
+}
+
+// drainConnections waits for the open connections to finish. Connections
+// waiting for a request get idleTimeout to send one before they are closed,
+// the requests in flight get up to drainTimeout
+func drainConnections(idleTimeout, drainTimeout time.Duration) {
+	start := time.Now()
+	idleClosed := false
+	for activeConnections.Load() > 0 {
+		waited := time.Since(start)
+		if !idleClosed && waited >= idleTimeout {
+			closeIdleConnections()
+			idleClosed = true
+		}
+		if idleClosed && waited >= drainTimeout {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if open := activeConnections.Load(); open > 0 {
+		warnf("Exiting with %d connection(s) still open after %s", open, time.Since(start).Round(time.Millisecond))
+		return
+	}
+	infof("All connections closed, exiting")
+}
+
+// idleConnections holds the HTTP/1 connections waiting for a request. A
+// shutdown closes them once they have had -shutdown-timeout to send one, and
+// from then on any connection that starts waiting
+var idleConnections = struct {
+	sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}{conns: make(map[net.Conn]bool)}
+
+// waitingForRequest records whether conn is waiting for a request. It is
+// called after the connection has set its own read deadline
+func waitingForRequest(conn net.Conn, waiting bool) {
+	idleConnections.Lock()
+	defer idleConnections.Unlock()
+	if !waiting {
+		delete(idleConnections.conns, conn)
+		return
+	}
+	if idleConnections.closed {
+		conn.SetReadDeadline(time.Now()) // ends the wait at once
+		return
+	}
+	idleConnections.conns[conn] = true
+}
+
+// closeIdleConnections wakes up every connection waiting for a request with
+// an expired read deadline, so it closes
+func closeIdleConnections() {
+	idleConnections.Lock()
+	defer idleConnections.Unlock()
+	idleConnections.closed = true
+	for conn := range idleConnections.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
 
+// acceptConnections runs the accept loop of a listener, handing each
+// connection to its own goroutine while a slot is free
+func acceptConnections(listener net.Listener, sem chan struct{}) {
 	// step 4: Accept connections loop
+	var backoff acceptBackoff
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			if shuttingDown() {
+				return
+			}
+			if isTemporaryAcceptError(err) {
+				backoff.wait(err)
+				continue
+			}
+			errorf("Failed to accept connection: %v", err)
+			continue
+		}
+		backoff.reset()
+		// Refused clients never take a slot. Behind a PROXY header the real
+		// address is only known once the connection is being handled
+		if !*proxyProtocol && !aclPermits(hostOnly(conn.RemoteAddr().String())) {
+			go refuseConnection(conn)
+			continue
+		}
+		// With an accept queue a connection waits for its slot in its own
+		// goroutine; without one the accept loop itself waits for a free slot
+		if *acceptQueue > 0 {
+			go func() {
+				if !acquireSlot(sem) {
+					rejectConnection(conn)
+					return
+				}
+				handleConnection(conn, sem)
+			}()
+			continue
+		}
+		if !acquireSlot(sem) {
+			go rejectConnection(conn)
 			continue
 		}
-		sem <- struct{}{}
 		// step 5: Start a goroutine for each connection
 		go handleConnection(conn, sem)
 	}
 }
 
-func handleConnection(conn net.Conn, sem chan struct{}) {
-	// Ensure the connection is closed and semaphore is released when the function exits
-	defer conn.Close()
-	defer func() {
-		<-sem // Release semaphore
-		log.Printf("Connection %s closed, released a slot", conn.RemoteAddr().String())
-	}()
+// slotMu makes checking the connection limit and taking a slot one step
+var slotMu sync.Mutex
 
-	log.Printf("Handling new connection: %s", conn.RemoteAddr().String())
-	reader := bufio.NewReader(conn)
+// slotPollInterval is how often a waiting connection rechecks a connection
+// limit that -mem-limit has lowered
+const slotPollInterval = 50 * time.Millisecond
 
-	// step 1: Parse request (using net/http parser)
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		log.Printf("Failed to parse request: %v", err)
-		if err != io.EOF && !strings.Contains(err.Error(), "connection reset") {
-			sendErrorResponse(conn, http.StatusBadRequest, "Bad Request")
-		}
-		return
+// acquireSlot takes a connection slot within the current connection limit,
+// waiting for one if need be. It returns false when the connection should be
+// turned away: the limit is lowered by -mem-limit, -accept-queue is full, or
+// no slot freed up within -queue-timeout. Without -accept-queue it waits for
+// as long as it takes
+func acquireSlot(sem chan struct{}) bool {
+	if trySlot(sem) {
+		return true
 	}
+	// Under memory pressure new work is shed at once
+	if connectionLimit.Load() < int64(cap(sem)) {
+		return false
+	}
+	if *acceptQueue == 0 {
+		return waitSlot(sem, nil)
+	}
+	if queuedConnections.Add(1) > int64(*acceptQueue) {
+		queuedConnections.Add(-1)
+		return false
+	}
+	defer queuedConnections.Add(-1)
+	timer := time.NewTimer(*queueTimeout)
+	defer timer.Stop()
+	return waitSlot(sem, timer.C)
+}
 
-	// step 2: Route based on method
-	switch req.Method {
-	case "GET":
-		handleGet(conn, req)
-	case "POST":
-		handlePost(conn, req)
+// trySlot takes a slot if one is free within the current connection limit
+func trySlot(sem chan struct{}) bool {
+	slotMu.Lock()
+	defer slotMu.Unlock()
+	if int64(len(sem)) >= connectionLimit.Load() {
+		return false
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
 	default:
-		// Other methods return 501 Not Implemented
-		sendErrorResponse(conn, http.StatusNotImplemented, "Not Implemented")
+		return false
 	}
 }
 
-func handleGet(conn net.Conn, req *http.Request) {
-	path := filepath.Clean("./" + req.URL.Path)
-	if path == "./" {
-		path = "./index.html" // Default to serving index.html
+// waitSlot waits until a slot within the connection limit is free and takes
+// it, or returns false once expired fires
+func waitSlot(sem chan struct{}, expired <-chan time.Time) bool {
+	poll := time.NewTicker(slotPollInterval)
+	defer poll.Stop()
+	for {
+		// At the full limit a freed slot is taken at once, otherwise the
+		// lowered limit is polled
+		var slot chan struct{}
+		if connectionLimit.Load() >= int64(cap(sem)) {
+			slot = sem
+		} else if trySlot(sem) {
+			return true
+		}
+		select {
+		case slot <- struct{}{}:
+			return true
+		case <-poll.C:
+		case <-expired:
+			return false
+		}
 	}
+}
 
-	// step 1: Check extension and Content-Type
-	ext := filepath.Ext(path)
-	contentType, ok := mimeTypes[ext]
-	if !ok {
-		log.Printf("Unsupported file type: %s (path: %s)", ext, path)
-		sendErrorResponse(conn, http.StatusBadRequest, "Bad Request: Unsupported file type")
-		return
+// memoryCheckInterval is how often -mem-limit compares the heap size to the limit
+const memoryCheckInterval = time.Second
+
+// watchMemory halves the connection limit while the heap is above limit and
+// raises it again one step at a time once the heap is back under 80% of it
+func watchMemory(limit uint64) {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	var stats runtime.MemStats
+	for range ticker.C {
+		runtime.ReadMemStats(&stats)
+		current := connectionLimit.Load()
+		next := current
+		switch {
+		case stats.HeapAlloc > limit:
+			next = max(current/2, 1)
+		case stats.HeapAlloc < limit/10*8:
+			next = min(current+1, int64(*maxConnections))
+		}
+		if next != current {
+			connectionLimit.Store(next)
+			infof("Heap is %d bytes (limit %d), connection limit now %d", stats.HeapAlloc, limit, next)
+		}
 	}
+}
 
-	// step 2: Try to open the file
-	file, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("File not found: %s", path)
-			sendErrorResponse(conn, http.StatusNotFound, "Not Found")
-		} else {
-			log.Printf("Failed to open file: %v", err)
-			sendErrorResponse(conn, http.StatusInternalServerError, "Internal Server Error")
+// rejectConnection turns away a connection that is over the current connection limit
+func rejectConnection(conn net.Conn) {
+	defer conn.Close()
+	rejectedConnections.Add(1)
+	warnf("Rejecting connection %s: over the connection limit of %d", conn.RemoteAddr().String(), connectionLimit.Load())
+	sendErrorResponse(conn, http.StatusServiceUnavailable, "Server is overloaded")
+}
+
+// allowNets and denyNets are the parsed -allow-cidrs and -deny-cidrs
+var allowNets, denyNets []*net.IPNet
+
+// parseCIDRs parses a comma-separated list of CIDRs, where a plain address
+// stands for itself
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
 		}
-		return
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
 	}
-	defer file.Close()
+	return nets, nil
+}
 
-	// step 3: Get file size (for Content-Length)
-	stat, err := file.Stat()
-	if err != nil {
-		log.Printf("Failed to get file stat: %v", err)
-		sendErrorResponse(conn, http.StatusInternalServerError, "Internal Server Error")
-		return
+// aclPermits reports whether a client IP may connect: it must not be in
+// -deny-cidrs and, when -allow-cidrs is set, must be in it
+func aclPermits(clientIP string) bool {
+	if len(allowNets) == 0 && len(denyNets) == 0 {
+		return true
 	}
-	fileSize := stat.Size()
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range denyNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(allowNets) == 0 {
+		return true
+	}
+	for _, ipNet := range allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	// step 4: Send 200 OK response headers
-	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n")
-	fmt.Fprintf(conn, "Content-Type: %s\r\n", contentType)
-	fmt.Fprintf(conn, "Content-Length: %d\r\n", fileSize)
-	fmt.Fprintf(conn, "Connection: close\r\n") 
-	fmt.Fprintf(conn, "\r\n") // End of headers
+// proxiedConn reports the client address from a PROXY header as its remote address
+type proxiedConn struct {
+	net.Conn
+	remoteAddr string
+}
 
-	// step 5: Send file content (body)
-	_, err = io.Copy(conn, file)
-	if err != nil {
-		log.Printf("Failed to send file body: %v", err)
+func (c proxiedConn) RemoteAddr() net.Addr { return stringAddr(c.remoteAddr) }
+
+// refuseConnection turns away a client refused by -allow-cidrs/-deny-cidrs,
+// with 403 Forbidden unless -acl-drop is set
+func refuseConnection(conn net.Conn) {
+	defer conn.Close()
+	warnf("Refusing connection from %s: not permitted by the access list", conn.RemoteAddr().String())
+	if !*aclDrop {
+		sendErrorResponse(conn, http.StatusForbidden, "")
 	}
 }
 
-func handlePost(conn net.Conn, req *http.Request) {
-	// step 1: Similarly clean the path
-	path := filepath.Clean("./" + req.URL.Path)
+// maxDelayParam caps the delay a client can ask for with ?delay=
+const maxDelayParam = time.Minute
 
-	// step 2: Ensure directory exists
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Printf("Failed to create directory: %v", err)
-		sendErrorResponse(conn, http.StatusInternalServerError, "Internal Server Error")
-		return
+// requestDelay returns the -delay plus any ?delay= asked for by the client when -allow-delay-param is set
+func requestDelay(req *http.Request) time.Duration {
+	delay := *responseDelay
+	if *allowDelay {
+		if value := req.URL.Query().Get("delay"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				warnf("Ignoring invalid delay parameter %q", value)
+			} else {
+				delay += min(d, maxDelayParam)
+			}
+		}
+	}
+	return delay
+}
+
+// waitDelay holds a response back for delay. A shutdown cuts the wait short,
+// and it returns false if the client hangs up in the meantime
+func waitDelay(conn *countingConn, req *http.Request, delay time.Duration) bool {
+	// net/http cancels an HTTP/2 request's context when its stream goes away;
+	// an idle HTTP/1 connection is watched for the client closing it
+	hangup := req.Context().Done()
+	if conn.reader != nil && conn.reader.Buffered() == 0 && req.ContentLength == 0 {
+		var stop func()
+		hangup, stop = watchHangup(conn)
+		defer stop()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-shutdown:
+	case <-hangup:
+		return false
+	}
+	return true
+}
+
+// watchHangup peeks at the connection until stop is called, closing the
+// returned channel if the client closes the connection meanwhile. Anything
+// the client sends instead stays buffered for the next request
+func watchHangup(conn *countingConn) (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := conn.reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(gone)
+		}
+	}()
+	return gone, func() {
+		conn.SetReadDeadline(time.Now()) // wakes up the Peek
+		<-done
+		conn.SetReadDeadline(time.Time{})
 	}
+}
+
+// secretFlags are the flags whose values are masked when the configuration is
+// logged: they point at credentials and keys
+var secretFlags = map[string]bool{
+	"htpasswd": true,
+	"jwt-key":  true,
+	"tls-key":  true,
+}
+
+// envPrefix starts the environment variable names that configure the server
+const envPrefix = "WEBSERVER_"
 
-	// step 3: Create file (overwrite if exists)
-	file, err := os.Create(path)
+// configSource records where each setting came from: "flag", "env" or "config", "default" when missing
+var configSource = make(map[string]string)
+
+// envName returns the environment variable for a flag, e.g. -ip-quota -> WEBSERVER_IP_QUOTA
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag not given on the command line from its environment
+// variable, so the precedence is flag > env > default
+func applyEnv() {
+	flag.Visit(func(f *flag.Flag) { configSource[f.Name] = "flag" })
+	flag.VisitAll(func(f *flag.Flag) {
+		if configSource[f.Name] != "" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := flag.Set(f.Name, value); err != nil {
+			fatalf("Invalid %s=%q: %v", envName(f.Name), value, err)
+		}
+		configSource[f.Name] = "env"
+	})
+}
+
+// applyConfigFile sets every flag given neither on the command line nor in
+// the environment from the -config file, so the precedence is
+// flag > env > config > default. The file's [mime] table adds to or overrides
+// the extension map. It returns the file's port, "" when it has none
+func applyConfigFile(path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Printf("Failed to create file: %v", err)
-		sendErrorResponse(conn, http.StatusInternalServerError, "Internal Server Error")
-		return
+		return "", err
 	}
 	defer file.Close()
-
-	// step 4: Write request body (req.Body) to file
-	bytesCopied, err := io.Copy(file, req.Body)
+	entries, err := parseConfig(file)
 	if err != nil {
-		log.Printf("Failed to write to file: %v", err)
-		sendErrorResponse(conn, http.StatusInternalServerError, "Internal Server Error")
-		return
+		return "", fmt.Errorf("%s:%v", path, err)
+	}
+
+	port := ""
+	for _, entry := range entries {
+		switch {
+		case entry.section == "mime":
+			if !strings.HasPrefix(entry.key, ".") || entry.value == "" {
+				return "", fmt.Errorf("%s:%d: mime entries look like \".ext\" = \"type/subtype\"", path, entry.line)
+			}
+			configMimeTypes[strings.ToLower(entry.key)] = entry.value
+		case entry.section != "":
+			return "", fmt.Errorf("%s:%d: unknown table [%s]", path, entry.line, entry.section)
+		case entry.key == "port":
+			if _, err := strconv.Atoi(entry.value); err != nil {
+				return "", fmt.Errorf("%s:%d: invalid port %q", path, entry.line, entry.value)
+			}
+			port = entry.value
+		case entry.key == "config":
+			return "", fmt.Errorf("%s:%d: config files cannot include other config files", path, entry.line)
+		default:
+			if flag.Lookup(entry.key) == nil {
+				return "", fmt.Errorf("%s:%d: unknown setting %q", path, entry.line, entry.key)
+			}
+			if configSource[entry.key] != "" {
+				continue
+			}
+			if err := flag.Set(entry.key, entry.value); err != nil {
+				return "", fmt.Errorf("%s:%d: invalid %s %q: %v", path, entry.line, entry.key, entry.value, err)
+			}
+			configSource[entry.key] = "config"
+		}
 	}
+	return port, nil
+}
 
-	log.Printf("Successfully POSTed %d bytes to %s", bytesCopied, path)
+// configEntry is one key = value line of a config file
+type configEntry struct {
+	section string
+	key     string
+	value   string
+	line    int
+}
 
-	// step 5: Send 201 Created response
-	fmt.Fprintf(conn, "HTTP/1.1 201 Created\r\n")
-	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
-	fmt.Fprintf(conn, "Content-Length: 0\r\n")
-	fmt.Fprintf(conn, "Connection: close\r\n")
-	fmt.Fprintf(conn, "\r\n")
+// parseConfig reads the subset of TOML used for config files: [table]
+// headers, and key = value lines with bare or quoted keys, string, number or
+// boolean values, and # comments. Values are returned as their flag text
+func parseConfig(r io.Reader) ([]configEntry, error) {
+	var entries []configEntry
+	seen := make(map[string]bool)
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			name, rest, ok := strings.Cut(line[1:], "]")
+			rest = strings.TrimSpace(rest)
+			if !ok || strings.TrimSpace(name) == "" || (rest != "" && !strings.HasPrefix(rest, "#")) {
+				return nil, fmt.Errorf("%d: invalid table header", lineNo)
+			}
+			section = strings.TrimSpace(name)
+			continue
+		}
+
+		key, rest, err := parseConfigToken(line)
+		if err != nil {
+			return nil, fmt.Errorf("%d: invalid key: %v", lineNo, err)
+		}
+		rest, ok := strings.CutPrefix(strings.TrimSpace(rest), "=")
+		if !ok {
+			return nil, fmt.Errorf("%d: expected key = value", lineNo)
+		}
+		value, rest, err := parseConfigToken(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("%d: invalid value for %s: %v", lineNo, key, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("%d: unexpected %q after the value of %s", lineNo, rest, key)
+		}
+		if seen[section+"."+key] {
+			return nil, fmt.Errorf("%d: %s is set twice", lineNo, key)
+		}
+		seen[section+"."+key] = true
+		entries = append(entries, configEntry{section: section, key: key, value: value, line: lineNo})
+	}
+	return entries, scanner.Err()
 }
 
-// sendErrorResponse is a helper function to send error responses
-func sendErrorResponse(conn net.Conn, code int, status string) {
-	body := fmt.Sprintf("%d %s", code, status)
-	log.Printf("Sending error: %s", body)
+// parseConfigToken splits a quoted string or a bare word off the start of s
+func parseConfigToken(s string) (token, rest string, err error) {
+	if strings.HasPrefix(s, "\"") {
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				token, err = strconv.Unquote(s[:i+1])
+				return token, s[i+1:], err
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	}
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		return "", "", fmt.Errorf("arrays and inline tables are not supported")
+	}
+	end := strings.IndexAny(s, " \t=#")
+	if end < 0 {
+		end = len(s)
+	}
+	if end == 0 {
+		return "", "", fmt.Errorf("missing")
+	}
+	return s[:end], s[end:], nil
+}
 
-	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", code, status)
-	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
-	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
-	fmt.Fprintf(conn, "Connection: close\r\n")
-	fmt.Fprintf(conn, "\r\n") // End of headers
-	fmt.Fprintf(conn, "%s", body)
-}
\ No newline at end of file
+// logConfig logs the effective configuration in one block so a deployment can be checked at a glance
+func logConfig(address string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Effective configuration:\n")
+	fmt.Fprintf(&b, "  listen address = %s (port from %s)\n", address, configSource["port"])
+	fmt.Fprintf(&b, "  document root = %s\n", rootDir)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && secretFlags[f.Name] {
+			value = "********"
+		}
+		source := configSource[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(&b, "  -%s = %q (%s)\n", f.Name, value, source)
+	})
+	infof("%s", strings.TrimSuffix(b.String(), "\n"))
+}
+
+// listen opens the -network listener, sharing the port with SO_REUSEPORT when -reuseport is set
+func listen(address string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if *reusePort {
+		lc.Control = setReusePort
+	}
+	return lc.Listen(context.Background(), *network, address)
+}
+
+// validNetwork reports whether a -network value can be passed to net.Listen
+func validNetwork(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6"
+}
+
+// Accept backoff limits used when the process runs out of file descriptors
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// acceptBackoff throttles the accept loop while Accept keeps failing with temporary errors
+type acceptBackoff struct {
+	delay  time.Duration
+	errors int
+}
+
+// wait sleeps after a temporary accept error, doubling the delay each time.
+// Only the first error of an episode is logged.
+func (b *acceptBackoff) wait(err error) {
+	if b.delay == 0 {
+		b.delay = minAcceptBackoff
+		warnf("Temporary error accepting connections, backing off: %v", err)
+	} else {
+		b.delay = min(b.delay*2, maxAcceptBackoff)
+	}
+	b.errors++
+	time.Sleep(b.delay)
+}
+
+// reset ends a backoff episode after a successful accept
+func (b *acceptBackoff) reset() {
+	if b.errors > 0 {
+		infof("Accepting connections again after %d temporary errors", b.errors)
+	}
+	b.delay = 0
+	b.errors = 0
+}
+
+// isTemporaryAcceptError reports whether an Accept error is worth retrying after a pause,
+// such as running out of file descriptors: EMFILE and ENFILE report themselves
+// as temporary, and naming them would not build on Plan 9
+func isTemporaryAcceptError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
+func handleConnection(conn net.Conn, sem chan struct{}) {
+	// Ensure the connection is closed and semaphore is released when the function exits
+	defer conn.Close()
+
+	// HTTPS connections that negotiate HTTP/2 are served by net/http
+	if tlsConn, ok := conn.(*tls.Conn); ok && *http2Enabled {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			warnf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			<-sem // Release semaphore
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			serveHTTP2Conn(tlsConn)
+			<-sem // Release semaphore
+			return
+		}
+	}
+	start := time.Now()
+	remoteAddr := conn.RemoteAddr().String()
+
+	// Count the bytes in both directions for quotas and the connection summary
+	counter := &countingConn{Conn: conn}
+	conn = counter
+	requests := 0
+	activeConnections.Add(1)
+	defer func() {
+		activeConnections.Add(-1)
+		debugf("Connection %s closed after %d request(s), %d bytes read, %d bytes written in %s, released a slot",
+			remoteAddr, requests, counter.read, counter.written, time.Since(start).Round(time.Millisecond))
+	}()
+
+	reader := bufio.NewReader(conn)
+	counter.reader = reader
+
+	// The slot is given back however the connection ends, and while it idles
+	held := true
+	defer func() {
+		if held {
+			<-sem // Release semaphore
+		}
+	}()
+
+	// A client that trickles in its first request must not hold a slot forever
+	var headerDeadline time.Time
+	if *headerTimeout > 0 {
+		headerDeadline = time.Now().Add(*headerTimeout)
+		conn.SetReadDeadline(headerDeadline)
+	}
+
+	// Behind a load balancer the real client address comes from the PROXY header
+	if *proxyProtocol {
+		addr, err := readProxyHeader(reader)
+		if err != nil {
+			warnf("Rejecting connection from %s: invalid PROXY header: %v", remoteAddr, err)
+			return
+		}
+		if addr != "" {
+			debugf("Connection %s is proxied for %s", remoteAddr, addr)
+			remoteAddr = addr
+		}
+	}
+
+	debugf("Handling new connection: %s", remoteAddr)
+	clientIP := hostOnly(remoteAddr)
+	if *proxyProtocol && !aclPermits(clientIP) {
+		held = false
+		<-sem // Release semaphore
+		refuseConnection(proxiedConn{conn, remoteAddr})
+		return
+	}
+
+	// step 1: Serve requests until the client closes, asks to close or goes idle
+	for {
+		readBefore := counter.read
+
+		// An idle persistent connection waits for its next request without holding a slot
+		if requests > 0 {
+			conn.SetReadDeadline(time.Now().Add(*keepAliveTimeout))
+			if reader.Buffered() == 0 {
+				<-sem
+				held = false
+				waitingForRequest(conn, true)
+				_, err := reader.Peek(1)
+				waitingForRequest(conn, false)
+				if err != nil {
+					return
+				}
+				if !acquireSlot(sem) {
+					counter.startResponse(false)
+					rejectConnection(conn)
+					return
+				}
+				held = true
+			}
+			if *headerTimeout > 0 {
+				headerDeadline = time.Now().Add(*headerTimeout)
+				conn.SetReadDeadline(headerDeadline)
+			}
+		}
+
+		// step 2: Parse request (using net/http parser)
+		waitingForRequest(conn, true)
+		req, err := http.ReadRequest(reader)
+		waitingForRequest(conn, false)
+		if err != nil {
+			warnf("Failed to parse request: %v", err)
+			counter.startResponse(false)
+			_, isTLS := counter.Conn.(*tls.Conn)
+			counter.extraHeader = securityHeader(isTLS)
+			// A timeout cutting a header line short surfaces as a parse error
+			if errors.Is(err, os.ErrDeadlineExceeded) || (*headerTimeout > 0 && time.Now().After(headerDeadline)) {
+				// Only a request that had started arriving is answered
+				if counter.read > readBefore {
+					sendClosingError(conn, http.StatusRequestTimeout, "")
+				}
+			} else if err != io.EOF && !strings.Contains(err.Error(), "connection reset") {
+				// The stream cannot be trusted after malformed input
+				sendClosingError(conn, http.StatusBadRequest, "")
+			}
+			return
+		}
+		// Like net/http, tell handlers about the TLS connection the request came on
+		if tlsConn, ok := counter.Conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+		bodyDeadline := time.Time{}
+		if *bodyTimeout > 0 && req.ContentLength != 0 {
+			bodyDeadline = time.Now().Add(*bodyTimeout)
+		}
+		conn.SetReadDeadline(bodyDeadline)
+		requests++
+		counter.keepAlive = *keepAliveTimeout > 0 && !req.Close && !shuttingDown()
+
+		// A long-lived connection is bounded over all its requests: the one
+		// that reaches a limit is told the connection closes after it
+		if counter.keepAlive && *connMaxRequests > 0 && requests >= *connMaxRequests {
+			debugf("Closing connection %s after its response: reached %d requests", remoteAddr, requests)
+			counter.keepAlive = false
+		}
+		if counter.keepAlive && *connMaxBytes > 0 && counter.read >= *connMaxBytes {
+			warnf("Closing connection %s after its response: read %d bytes, over -conn-max-bytes", remoteAddr, counter.read)
+			counter.keepAlive = false
+		}
+
+		// A client that reads the response too slowly loses the connection
+		var writeDeadline time.Time
+		if *writeTimeout > 0 {
+			writeDeadline = time.Now().Add(*writeTimeout)
+			conn.SetWriteDeadline(writeDeadline)
+		}
+		handleRequest(counter, req, remoteAddr, clientIP)
+		if *writeTimeout > 0 {
+			if time.Now().After(writeDeadline) {
+				warnf("Closing connection %s: response not written within %s", remoteAddr, *writeTimeout)
+				return
+			}
+			conn.SetWriteDeadline(time.Time{})
+		}
+
+		// step 3: Whatever the handler left of the body has to be read before the next request
+		if !counter.keepAlive {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(*keepAliveTimeout))
+		if !drainBody(req.Body) {
+			warnf("Closing connection %s: request body was not fully read", remoteAddr)
+			return
+		}
+		if *connMaxBytes > 0 && counter.read >= *connMaxBytes {
+			warnf("Closing connection %s: read %d bytes, over -conn-max-bytes", remoteAddr, counter.read)
+			return
+		}
+	}
+}
+
+// handleRequest answers a single request read from a connection
+func handleRequest(conn *countingConn, req *http.Request, remoteAddr, clientIP string) {
+	// Track the request's duration, status and size for the access and slow request logs
+	requestStart := time.Now()
+	writtenBefore := conn.written
+	conn.startResponse(req.Method == "HEAD")
+	conn.extraHeader = securityHeader(req.TLS != nil)
+	defer func() {
+		duration := time.Since(requestStart)
+		logAccess(req, clientIP, conn.user, conn.status, conn.bodyWritten, duration)
+		logSlowRequest(req, conn.status, conn.written-writtenBefore, duration)
+		// Charged per request so a long keep-alive connection cannot outrun the quota
+		if quota != nil {
+			quota.add(clientIP, conn.written-writtenBefore)
+		}
+	}()
+
+	// ACME challenges are always answered so certificate renewal keeps working
+	if *acmeWebroot != "" && req.Method == "GET" && strings.HasPrefix(req.URL.Path, *acmePath) {
+		serveAcmeChallenge(conn, req)
+		return
+	}
+
+	// Health probes are never throttled
+	if *healthPath != "" && (req.Method == "GET" || req.Method == "HEAD") && req.URL.Path == *healthPath {
+		serveHealth(conn, req)
+		return
+	}
+
+	// step 1: Refuse clients that have used up their bandwidth quota
+	if quota != nil && quota.exceeded(clientIP) {
+		warnf("Bandwidth quota exceeded for %s", clientIP)
+		sendErrorResponse(conn, http.StatusTooManyRequests, "")
+		return
+	}
+	if limiter != nil {
+		if ok, wait := limiter.allow(clientIP); !ok {
+			warnf("Rate limit exceeded for %s", clientIP)
+			sendTooManyRequests(conn, wait)
+			return
+		}
+	}
+
+	// Testing aid: hold the response back to simulate a slow server
+	if delay := requestDelay(req); delay > 0 {
+		debugf("Delaying response to %s by %s", remoteAddr, delay)
+		if !waitDelay(conn, req, delay) {
+			debugf("Client %s went away during the delay", remoteAddr)
+			conn.keepAlive = false
+			return
+		}
+	}
+
+	// A vanished document root is reported clearly instead of as a stream of 404s and 500s
+	if !rootAvailable.Load() {
+		sendErrorResponse(conn, http.StatusServiceUnavailable, "Document root unavailable")
+		return
+	}
+
+	// Hosts that are not served here are sent back to the client to retry
+	// elsewhere, on a fresh connection as 421 asks
+	if _, ok := vhostRoot(req.Host); !ok || misdirectedTLS(req) {
+		warnf("Misdirected request for host %q", req.Host)
+		closeAfterResponse(conn)
+		sendErrorResponse(conn, http.StatusMisdirectedRequest, "")
+		return
+	}
+
+	// Moved content is redirected without touching the filesystem
+	if target, code, ok := redirects.lookup(req.URL); ok {
+		sendRedirect(conn, code, target)
+		return
+	}
+
+	// Legacy URLs are mapped to their current location before anything looks at the path
+	if len(rewrites) > 0 && applyRewrites(conn, req) {
+		return
+	}
+
+	// Allowed origins may read the response. Their preflights are answered
+	// here, as browsers send them without credentials
+	corsRule := corsRuleFor(req.URL.Path)
+	if origin := corsOrigin(req, corsRule); origin != "" {
+		if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+			sendPreflight(conn, req, origin)
+			return
+		}
+		if conn.extraHeader == nil {
+			conn.extraHeader = make(http.Header)
+		}
+		conn.extraHeader.Set("Access-Control-Allow-Origin", origin)
+		conn.extraHeader.Set("Access-Control-Expose-Headers", "ETag, Location, Content-Range")
+	}
+	// Below a rule naming origins the response depends on Origin, also for
+	// the requests that get no CORS headers
+	if corsRule != nil && !corsRule.anyOrigin() {
+		if conn.extraHeader == nil {
+			conn.extraHeader = make(http.Header)
+		}
+		conn.extraHeader.Set("Vary", "Origin")
+	}
+
+	// Writes need a signed bearer token with -jwt-key, which then also stands
+	// in for the -htpasswd user. Reads stay anonymous
+	bearerOK := false
+	if writeMethod(req.Method) && (jwtHMACKey != nil || jwtRSAKey != nil) {
+		if err := verifyBearer(req); err != nil {
+			warnf("Rejecting %s %s from %s: %v", req.Method, req.URL.Path, clientIP, err)
+			sendBearerChallenge(conn)
+			return
+		}
+		bearerOK = true
+	}
+
+	// Protected paths need a user from -htpasswd
+	if htpasswdUsers != nil && !bearerOK && requiresAuth(req.URL.Path) {
+		if !authorized(req) {
+			warnf("Unauthorized request for %s from %s", req.URL.Path, clientIP)
+			sendUnauthorized(conn)
+			return
+		}
+		conn.user, _, _ = req.BasicAuth()
+	}
+
+	// step 2: Route based on method
+	switch req.Method {
+	case "GET", "HEAD":
+		// HEAD runs the GET logic, the connection drops the body
+		handleGet(conn, req)
+	case "POST", "PUT":
+		// PUT shares the upload path, replacing the target in place
+		handlePost(conn, req)
+	case "DELETE":
+		if !*allowDelete {
+			sendMethodNotAllowed(conn, req)
+			return
+		}
+		handleDelete(conn, req)
+	case "OPTIONS":
+		handleOptions(conn, req)
+	default:
+		// Other methods return 501 Not Implemented
+		sendErrorResponse(conn, http.StatusNotImplemented, "")
+	}
+}
+
+// maxDrainBytes is the most of an unread request body discarded to keep a connection open
+const maxDrainBytes = 256 << 10
+
+// drainBody discards the rest of a request body, reporting false when it is
+// too large or cannot be read and the connection has to be closed instead
+func drainBody(body io.Reader) bool {
+	n, err := io.CopyN(io.Discard, body, maxDrainBytes+1)
+	return err == io.EOF && n <= maxDrainBytes
+}
+
+// connectionHeader is the Connection header value for the response being
+// written on conn, keep-alive when another request may follow
+func connectionHeader(conn net.Conn) string {
+	c, ok := conn.(*countingConn)
+	if !ok {
+		return "close"
+	}
+	// A shutdown that began during the request ends the connection after it
+	if c.keepAlive && shuttingDown() {
+		c.keepAlive = false
+	}
+	if c.keepAlive {
+		return "keep-alive"
+	}
+	return "close"
+}
+
+// closeAfterResponse closes conn once the current response is done, for
+// responses whose end the client can only detect by the connection closing
+func closeAfterResponse(conn net.Conn) {
+	if c, ok := conn.(*countingConn); ok {
+		c.keepAlive = false
+	}
+}
+
+// selfSignedCertificate generates an in-memory certificate for -tls-self-signed,
+// valid for localhost, the loopback addresses and the machine's host name
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"lab1-webServer development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// ipStrings formats a list of IP addresses
+func ipStrings(ips []net.IP) []string {
+	var out []string
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+// clientAuthModes maps -client-auth-mode to how the TLS layer treats client certificates
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-any":        tls.RequireAnyClientCert,
+	"request":            tls.RequestClientCert,
+}
+
+// setClientAuth makes the HTTPS listener ask for client certificates and
+// verify them against the CAs in caFile, so bad ones fail the handshake
+func setClientAuth(config *tls.Config, caFile, mode string) error {
+	authType, ok := clientAuthModes[mode]
+	if !ok {
+		return fmt.Errorf("unknown -client-auth-mode %q", mode)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates in %s", caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = authType
+	return nil
+}
+
+// clientCertName returns the common name of the verified client certificate a
+// request came with, spaces replaced so it fits an access log field, or ""
+// when there is none
+func clientCertName(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return strings.ReplaceAll(req.TLS.VerifiedChains[0][0].Subject.CommonName, " ", "_")
+}
+
+// tlsHandshakeTimeout bounds how long a client may take to finish the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// h2Server serves the HTTP/2 connections handed to it through h2Listener,
+// running each request through handleRequest
+var h2Server = &http.Server{Handler: http.HandlerFunc(serveHTTP2Request), ConnState: trackHTTP2Conn}
+
+// h2Listener passes negotiated HTTP/2 connections to h2Server
+var h2Listener = newConnListener()
+
+// h2Done holds a channel per HTTP/2 connection that is closed when net/http is done with it
+var h2Done sync.Map
+
+// serveHTTP2Conn hands an HTTP/2 connection to h2Server and waits until it is
+// closed, so it keeps its connection slot for its whole life
+func serveHTTP2Conn(conn *tls.Conn) {
+	start := time.Now()
+	debugf("Handling new HTTP/2 connection: %s", conn.RemoteAddr())
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+
+	done := make(chan struct{})
+	h2Done.Store(conn, done)
+	if !h2Listener.push(conn) {
+		h2Done.Delete(conn)
+		conn.Close()
+		return
+	}
+	<-done
+	debugf("HTTP/2 connection %s closed after %s", conn.RemoteAddr(), time.Since(start).Round(time.Millisecond))
+}
+
+// trackHTTP2Conn wakes up serveHTTP2Conn once a connection is closed
+func trackHTTP2Conn(conn net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if done, ok := h2Done.LoadAndDelete(conn); ok {
+		close(done.(chan struct{}))
+	}
+}
+
+// serveHTTP2Request runs an HTTP/2 request through handleRequest, which
+// writes an HTTP/1.1 response, and relays that response to the stream
+func serveHTTP2Request(w http.ResponseWriter, req *http.Request) {
+	// step 1: Let the handler write into a pipe as if it were a connection
+	reader, writer := io.Pipe()
+	conn := &countingConn{Conn: &pipeConn{writer: writer, remote: stringAddr(req.RemoteAddr)}}
+	clientIP := hostOnly(req.RemoteAddr)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		handleRequest(conn, req, req.RemoteAddr, clientIP)
+		writer.Close()
+	}()
+	defer func() {
+		reader.Close() // unblocks a handler the client went away from
+		<-handled
+	}()
+
+	// step 2: Parse the response and copy it over, minus the hop-by-hop
+	// headers HTTP/2 does not allow
+	resp, err := http.ReadResponse(bufio.NewReader(reader), req)
+	if err != nil {
+		warnf("Failed to read response for HTTP/2 request %s: %v", req.URL.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade":
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		warnf("Failed to send HTTP/2 response for %s: %v", req.URL.Path, err)
+	}
+}
+
+// connListener is a net.Listener whose connections are pushed into it
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// push hands conn to Accept, reporting false once the listener is closed
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+// Accept waits for a pushed connection, failing with net.ErrClosed after Close
+// so that Serve returns
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return stringAddr("http2") }
+
+// pipeConn is the net.Conn an HTTP/2 request's handler writes its response
+// to. The request body comes from the http.Request, so reads see EOF
+type pipeConn struct {
+	writer *io.PipeWriter
+	remote net.Addr
+}
+
+func (c *pipeConn) Read(p []byte) (int, error)         { return 0, io.EOF }
+func (c *pipeConn) Write(p []byte) (int, error)        { return c.writer.Write(p) }
+func (c *pipeConn) Close() error                       { return c.writer.Close() }
+func (c *pipeConn) LocalAddr() net.Addr                { return stringAddr("http2") }
+func (c *pipeConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// stringAddr is a net.Addr for an address known only as a string
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
+
+// accessLog receives the -access-log lines, nil when it is off
+var accessLog *log.Logger
+
+// openAccessLog opens -access-log for appending
+func openAccessLog(path string) (*log.Logger, error) {
+	if path == "-" {
+		return log.New(os.Stdout, "", 0), nil
+	}
+	file, err := openRotatingFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return log.New(file, "", 0), nil
+}
+
+// logAccess writes a request's line to the access log in Common Log Format,
+// followed by the time taken in microseconds like Apache's %D. user is the
+// user the request authenticated as, "" if it did not
+func logAccess(req *http.Request, clientIP, user string, status int, size int64, duration time.Duration) {
+	if accessLog == nil {
+		return
+	}
+	bytesField := "-"
+	if size > 0 {
+		bytesField = strconv.FormatInt(size, 10)
+	}
+	// Only verified names are logged: Basic credentials sent to a path that
+	// does not check them could name anyone
+	if user == "" {
+		user = clientCertName(req)
+	}
+	if user == "" {
+		user = "-"
+	}
+	accessLog.Printf("%s - %s [%s] %q %d %s %d",
+		clientIP, user, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method+" "+req.RequestURI+" "+req.Proto, status, bytesField, duration.Microseconds())
+}
+
+// minLogLevel is the -log-level, messages below it are dropped
+var minLogLevel = slog.LevelInfo
+
+// jsonLogger writes the server log as JSON lines, nil for the plain text log
+var jsonLogger *slog.Logger
+
+// setupLogging applies -log-format, -log-level and -log-file
+func setupLogging() error {
+	if err := minLogLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level %q: must be debug, info, warn or error", *logLevel)
+	}
+	var out io.Writer = os.Stderr
+	if *logFile != "" {
+		file, err := openRotatingFile(*logFile)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		out = file
+	}
+	switch *logFormat {
+	case "text":
+		log.SetOutput(out)
+	case "json":
+		jsonLogger = slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: minLogLevel}))
+		// Messages from the standard library's log calls become JSON too
+		slog.SetDefault(jsonLogger)
+	default:
+		return fmt.Errorf("invalid -log-format %q: must be text or json", *logFormat)
+	}
+	return nil
+}
+
+// rotatingFile is a log file that is moved aside once it reaches
+// -log-max-size bytes or -log-max-age, keeping -log-max-backups old files
+// named <path>.<time>, gzipped with -log-compress
+type rotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// openRotatingFile opens path for appending
+func openRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open (re)opens the file, counting what it already holds toward -log-max-size
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tooBig := *logMaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > *logMaxSize
+	tooOld := *logMaxAge > 0 && time.Since(r.opened) > *logMaxAge
+	if tooBig || tooOld {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than lose messages
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", r.path, err)
+			r.opened = time.Now()
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one
+func (r *rotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	r.file.Close()
+	if err := r.open(); err != nil {
+		return err
+	}
+	// Compressing and pruning can be slow, so they do not hold up logging
+	go func() {
+		if *logCompress {
+			if err := gzipFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to compress %s: %v\n", backup, err)
+			}
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune deletes the oldest backups beyond -log-max-backups. The timestamp in
+// their names sorts them from oldest to newest
+func (r *rotatingFile) prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	backups, _ := filepath.Glob(r.path + ".[0-9]*")
+	sort.Strings(backups)
+	for len(backups) > *logMaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// gzipFile replaces path with path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// logf writes a server log message at the given level
+func logf(level slog.Level, format string, args ...any) {
+	if level < minLogLevel {
+		return
+	}
+	if jsonLogger != nil {
+		jsonLogger.Log(context.Background(), level, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf("%-5s %s", level, fmt.Sprintf(format, args...))
+}
+
+// debugf logs per-request details
+func debugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+
+// infof logs lifecycle events
+func infof(format string, args ...any) { logf(slog.LevelInfo, format, args...) }
+
+// warnf logs problems caused by clients or the environment that the server copes with
+func warnf(format string, args ...any) { logf(slog.LevelWarn, format, args...) }
+
+// errorf logs failures of the server itself
+func errorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
+
+// fatalf logs an error and exits
+func fatalf(format string, args ...any) {
+	logf(slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
+// logSlowRequest logs a request that took longer than -slow-log-threshold
+func logSlowRequest(req *http.Request, status int, size int64, duration time.Duration) {
+	if *slowLog <= 0 || duration <= *slowLog {
+		return
+	}
+	warnf("Slow request: %s %s status=%d bytes=%d duration=%s",
+		req.Method, req.URL.RequestURI(), status, size, duration.Round(time.Millisecond))
+}
+
+// vhostRoots maps the lower-case host names in -vhosts to absolute document roots
+var vhostRoots = make(map[string]string)
+
+// parseVhosts parses -vhosts "host=dir,host=dir", making each dir absolute and
+// checking that it is a directory
+func parseVhosts(value string) (map[string]string, error) {
+	roots := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, dir, ok := strings.Cut(entry, "=")
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if !ok || host == "" || strings.TrimSpace(dir) == "" {
+			return nil, fmt.Errorf("%q is not host=dir", entry)
+		}
+		abs, err := filepath.Abs(strings.TrimSpace(dir))
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("root of %s is not a directory: %s", host, abs)
+		}
+		roots[host] = abs
+	}
+	return roots, nil
+}
+
+// vhostRoot returns the document root for a Host header: its -vhosts entry,
+// or "" for the default root. ok is false when -strict-host rejects the host
+func vhostRoot(host string) (root string, ok bool) {
+	name := strings.TrimSuffix(strings.ToLower(hostOnly(host)), ".")
+	if root, found := vhostRoots[name]; found {
+		return root, true
+	}
+	return "", !*strictHost
+}
+
+// misdirectedTLS reports whether -strict-host is set and an HTTPS request's
+// Host differs from the server name the client asked for during the handshake
+func misdirectedTLS(req *http.Request) bool {
+	if !*strictHost {
+		return false
+	}
+	state := req.TLS
+	if state == nil || state.ServerName == "" {
+		return false
+	}
+	return !strings.EqualFold(state.ServerName, strings.TrimSuffix(hostOnly(req.Host), "."))
+}
+
+// insideRoot reports whether path still lies inside root ("" for the working
+// directory) once symlinks are resolved. Trailing parts of path that do not
+// exist yet, like the target of an upload, are taken as they are
+func insideRoot(root, path string) bool {
+	if root == "" {
+		root = "."
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	if realRoot, err = filepath.Abs(realRoot); err != nil {
+		return false
+	}
+
+	existing := path
+	resolved, err := filepath.EvalSymlinks(existing)
+	for os.IsNotExist(err) {
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return false
+		}
+		existing = parent
+		resolved, err = filepath.EvalSymlinks(existing)
+	}
+	if err != nil {
+		return false
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return false
+	}
+	return resolved == realRoot || strings.HasPrefix(resolved, realRoot+string(filepath.Separator))
+}
+
+// pathAlias is one -aliases entry: a URL prefix served from its own directory
+type pathAlias struct {
+	prefix   string // as given, e.g. "/static"
+	rel      string // the prefix as resolvePath returns it, e.g. "static"
+	dir      string // absolute
+	writable bool
+	listing  bool
+}
+
+// aliases are the parsed -aliases entries
+var aliases []pathAlias
+
+// parseAliases parses -aliases "/prefix=dir[:rw][:list|:nolist],...", making
+// each dir absolute
+func parseAliases(value string) ([]pathAlias, error) {
+	var parsed []pathAlias
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, target, ok := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		rel, err := resolvePath(prefix)
+		if !ok || !strings.HasPrefix(prefix, "/") || err != nil || rel == "." {
+			return nil, fmt.Errorf("%q is not /prefix=dir", entry)
+		}
+		options := strings.Split(strings.TrimSpace(target), ":")
+		alias := pathAlias{prefix: prefix, rel: rel, listing: *listings}
+		for _, option := range options[1:] {
+			switch option {
+			case "rw":
+				alias.writable = true
+			case "list":
+				alias.listing = true
+			case "nolist":
+				alias.listing = false
+			default:
+				return nil, fmt.Errorf("unknown option %q for %s", option, prefix)
+			}
+		}
+		if alias.dir, err = filepath.Abs(options[0]); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(alias.dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("directory of %s is not a directory: %s", prefix, alias.dir)
+		}
+		parsed = append(parsed, alias)
+	}
+	return parsed, nil
+}
+
+// aliasFor returns the alias with the longest prefix containing rel, or nil
+func aliasFor(rel string) *pathAlias {
+	var best *pathAlias
+	for i, alias := range aliases {
+		if (rel == alias.rel || strings.HasPrefix(rel, alias.rel+string(filepath.Separator))) &&
+			(best == nil || len(alias.rel) > len(best.rel)) {
+			best = &aliases[i]
+		}
+	}
+	return best
+}
+
+// requestFile maps a resolved request path to the file it names: inside an
+// alias directory, else inside the host's root. root is the directory the
+// path must not escape
+func requestFile(req *http.Request, rel string) (root, path string, alias *pathAlias) {
+	if alias = aliasFor(rel); alias != nil {
+		return alias.dir, filepath.Join(alias.dir, strings.TrimPrefix(rel, alias.rel)), alias
+	}
+	root, _ = vhostRoot(req.Host)
+	return root, filepath.Join(root, rel), nil
+}
+
+// listingsEnabled reports whether directories without an index are listed,
+// per alias or by -listings
+func listingsEnabled(alias *pathAlias) bool {
+	if alias != nil {
+		return alias.listing
+	}
+	return *listings
+}
+
+// resolvePath maps a URL path to a file path relative to the served directory,
+// rejecting paths that are too deep or that would escape the directory
+func resolvePath(urlPath string) (string, error) {
+	if *maxPathDepth > 0 {
+		depth := 0
+		for _, segment := range strings.Split(urlPath, "/") {
+			if segment != "" {
+				depth++
+			}
+		}
+		if depth > *maxPathDepth {
+			return "", fmt.Errorf("%d path segments, the limit is %d", depth, *maxPathDepth)
+		}
+	}
+
+	path := filepath.Clean("./" + urlPath)
+	if path != "." && !filepath.IsLocal(path) {
+		return "", fmt.Errorf("path escapes the served directory")
+	}
+	return path, nil
+}
+
+func handleGet(conn net.Conn, req *http.Request) {
+	if *sitemapPath != "" && req.URL.Path == *sitemapPath {
+		serveSitemap(conn)
+		return
+	}
+	if *statsPath != "" && req.URL.Path == *statsPath {
+		serveStats(conn, req)
+		return
+	}
+
+	rel, err := resolvePath(req.URL.Path)
+	if err != nil {
+		warnf("Rejecting path %q: %v", req.URL.Path, err)
+		sendErrorResponse(conn, http.StatusBadRequest, "")
+		return
+	}
+	pathHits.record(rel)
+	root, path, alias := requestFile(req, rel)
+	if !insideRoot(root, path) {
+		warnf("Refusing %s: it leads outside the document root", path)
+		sendErrorResponse(conn, http.StatusForbidden, "")
+		return
+	}
+	if *allowArchive && req.URL.Query().Get("archive") == "tar.gz" {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			serveArchive(conn, req, path)
+			return
+		}
+	}
+	if rel == "." {
+		if rootConfig.mode == "listing" {
+			serveListing(conn, req, path)
+			return
+		}
+		if rootConfig.mode != "index" {
+			serveRootBehavior(conn)
+			return
+		}
+	} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+		// Relative links in a directory's index only work under "/dir/"
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			location := req.URL.EscapedPath() + "/"
+			if req.URL.RawQuery != "" {
+				location += "?" + req.URL.RawQuery
+			}
+			sendRedirect(conn, http.StatusMovedPermanently, location)
+			return
+		}
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		// Default to serving index.html, or a listing when there is none
+		dir := path
+		path = filepath.Join(dir, "index.html")
+		if _, err := os.Stat(path); os.IsNotExist(err) && listingsEnabled(alias) {
+			serveListing(conn, req, dir)
+			return
+		}
+	}
+
+	// Single-page apps route on the client: a missing path that does not
+	// look like a file gets the app's index.html
+	if *spaFallback && filepath.Ext(rel) == "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			debugf("Serving the app index for %s", path)
+			path = filepath.Join(root, "index.html")
+		}
+	}
+
+	// Pick a localized name.<lang>.html variant when the client prefers one
+	language := ""
+	negotiateLanguage := *languages != "" && filepath.Ext(path) == ".html"
+	if negotiateLanguage {
+		path, language = languageVariant(path, req.Header.Get("Accept-Language"))
+	}
+
+	// step 1: Try to open the file, which may itself be a link out of the root
+	if !insideRoot(root, path) {
+		warnf("Refusing %s: it leads outside the document root", path)
+		sendErrorResponse(conn, http.StatusForbidden, "")
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if !checkRoot() {
+			sendErrorResponse(conn, http.StatusServiceUnavailable, "Document root unavailable")
+		} else if os.IsNotExist(err) {
+			debugf("File not found: %s", path)
+			if *suggest404 {
+				sendNotFoundWithSuggestions(conn, req, path)
+			} else {
+				sendErrorResponse(conn, http.StatusNotFound, "")
+			}
+		} else {
+			errorf("Failed to open file: %v", err)
+			sendErrorResponse(conn, http.StatusInternalServerError, "")
+		}
+		return
+	}
+	defer file.Close()
+
+	// step 2: Get file size (for Content-Length)
+	stat, err := file.Stat()
+	if err != nil {
+		errorf("Failed to get file stat: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	if stat.IsDir() {
+		debugf("Path is a directory: %s", path)
+		sendErrorResponse(conn, http.StatusNotFound, "")
+		return
+	}
+	fileSize := stat.Size()
+
+	// A hot small file comes from memory, type and ETag included
+	var cached *cachedFile
+	if fileCache != nil {
+		cached = fileCache.get(path, stat)
+	}
+
+	// step 3: Pick the Content-Type
+	var contentType string
+	if cached != nil {
+		contentType = cached.contentType
+	} else {
+		contentType = fileContentType(file, path)
+	}
+
+	// Header rules such as -uploads-dir are relative to the document root
+	relPath, _ := filepath.Rel(root, path)
+	if alias != nil {
+		relPath = filepath.Join(alias.rel, relPath)
+	}
+	header := fileHeaders(relPath, contentType)
+	if negotiateLanguage {
+		addVary(header, "Accept-Language")
+		if language != "" {
+			header.Set("Content-Language", language)
+		}
+	}
+	header.Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	var etag string
+	if cached != nil {
+		etag = cached.etag
+	} else {
+		etag = etagFunc(stat, path)
+		if fileCache != nil && fileSize <= *cacheMaxFile {
+			cached = fileCache.add(path, stat, file, contentType, etag)
+		}
+	}
+	var content io.ReadSeeker = file
+	if cached != nil {
+		content = bytes.NewReader(cached.body)
+	}
+
+	// A precompressed name.br or name.gz next to the file is sent as it is
+	if *precompressed {
+		addVary(header, "Accept-Encoding")
+		if sidecar, sidecarStat, encoding := openSidecar(req, root, path); sidecar != nil {
+			defer sidecar.Close()
+			header.Set("Content-Encoding", encoding)
+			content, fileSize = sidecar, sidecarStat.Size()
+			etag = etagFunc(sidecarStat, sidecar.Name())
+		}
+	}
+
+	// Text is compressed for clients that accept gzip, unless they asked for a byte range
+	compress := false
+	if *gzipEnabled && compressible(contentType) {
+		addVary(header, "Accept-Encoding")
+		compress = fileSize >= *gzipMinSize && req.Header.Get("Range") == "" && header.Get("Content-Encoding") == "" && acceptsEncoding(req, "gzip")
+		if compress && etag != "" {
+			// The compressed bytes are a different representation with their own tag
+			etag = strings.TrimSuffix(etag, "\"") + "-gzip\""
+		}
+	}
+
+	// A client whose cached copy is still current gets 304 Not Modified
+	if notModified(req, stat.ModTime(), etag) {
+		sendNotModified(conn, header, etag)
+		return
+	}
+	if compress {
+		sendCompressed(conn, req, content, path, contentType, header, etag)
+		return
+	}
+
+	// step 4: A single satisfiable byte range is answered with 206 Partial Content
+	status, start, length := http.StatusOK, int64(0), fileSize
+	if value := req.Header.Get("Range"); value != "" {
+		rangeStart, rangeLength, err := parseRange(value, fileSize)
+		switch {
+		case err == errUnsatisfiableRange:
+			warnf("Range %q is past the end of %s (%d bytes)", value, path, fileSize)
+			sendRangeNotSatisfiable(conn, fileSize)
+			return
+		case err != nil:
+			warnf("Ignoring Range %q: %v", value, err)
+		default:
+			// A cached file is sliced in memory. The capped capacity keeps the
+			// slice from ever reaching past the range into the cache's buffer
+			end := rangeStart + rangeLength
+			if cached != nil {
+				content = bytes.NewReader(cached.body[rangeStart:end:end])
+			} else if _, err := content.Seek(rangeStart, io.SeekStart); err != nil {
+				errorf("Failed to seek in %s: %v", path, err)
+				sendErrorResponse(conn, http.StatusInternalServerError, "")
+				return
+			}
+			status, start, length = http.StatusPartialContent, rangeStart, rangeLength
+		}
+	}
+
+	// A big download frees its connection slot once it is done, while small
+	// responses keep the connection for the client's next request
+	if *keepAliveMaxBody > 0 && length > *keepAliveMaxBody && req.Method != "HEAD" {
+		debugf("Closing the connection after sending %d bytes of %s", length, path)
+		closeAfterResponse(conn)
+	}
+
+	// step 5: Send the response headers, buffered so a vanished client is
+	// noticed once at Flush instead of again while copying the body
+	headers := getHeaderWriter(conn)
+	defer putHeaderWriter(headers)
+	writeStatusLine(headers, status)
+	fmt.Fprintf(headers, "Content-Type: %s\r\n", contentType)
+	fmt.Fprintf(headers, "Content-Length: %d\r\n", length)
+	fmt.Fprintf(headers, "Accept-Ranges: bytes\r\n")
+	if etag != "" {
+		fmt.Fprintf(headers, "ETag: %s\r\n", etag)
+	}
+	if status == http.StatusPartialContent {
+		fmt.Fprintf(headers, "Content-Range: bytes %d-%d/%d\r\n", start, start+length-1, fileSize)
+	}
+	header.Write(headers)
+	fmt.Fprintf(headers, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(headers, "\r\n") // End of headers
+	if err := headers.Flush(); err != nil {
+		warnf("Failed to send headers for %s: %v", path, err)
+		return
+	}
+	if req.Method == "HEAD" {
+		return
+	}
+
+	// step 6: Send file content (body), no more than the advertised length so
+	// a file growing meanwhile cannot corrupt the next response on the connection
+	sent, err := io.Copy(conn, io.LimitReader(content, length))
+	if err != nil {
+		warnf("Failed to send file body: %v", err)
+	}
+	if sent != length {
+		closeAfterResponse(conn)
+	}
+}
+
+// languageVariant returns the name.<lang>.html variant of path best matching
+// acceptLanguage among -languages, or path itself and "" when none exists
+func languageVariant(path, acceptLanguage string) (string, string) {
+	base := strings.TrimSuffix(path, ".html")
+	for _, tag := range preferredLanguages(acceptLanguage) {
+		for _, lang := range strings.Split(*languages, ",") {
+			lang = strings.TrimSpace(lang)
+			// "fr-CA" also accepts a plain "fr" variant
+			if lang == "" || !(strings.EqualFold(tag, lang) || strings.EqualFold(strings.SplitN(tag, "-", 2)[0], lang)) {
+				continue
+			}
+			variant := base + "." + lang + ".html"
+			if info, err := os.Stat(variant); err == nil && !info.IsDir() {
+				return variant, lang
+			}
+		}
+	}
+	return path, ""
+}
+
+// preferredLanguages returns the language tags of an Accept-Language header,
+// most preferred first, leaving out "*" and tags with q=0
+func preferredLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				q = v
+			}
+		}
+		if tag != "" && tag != "*" && q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
+
+// fileHeaders returns the security headers sent with a served file
+func fileHeaders(path, contentType string) http.Header {
+	header := make(http.Header)
+
+	// Stop browsers from sniffing files into a different (possibly active) type.
+	// Octet-stream is already a download, so it is left alone. -security-headers
+	// sends it with every response anyway
+	if !*noNosniff && !*securityHeaders && contentType != defaultMimeType {
+		header.Set("X-Content-Type-Options", "nosniff")
+	}
+
+	// Uploaded content is untrusted: sandbox it and never render active documents inline
+	if inUploadsDir(path) {
+		header.Set("Content-Security-Policy", *uploadsCSP)
+		if !*securityHeaders {
+			header.Set("X-Content-Type-Options", "nosniff")
+		}
+		switch filepath.Ext(path) {
+		case ".html", ".htm", ".svg":
+			header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+		}
+	}
+	return header
+}
+
+// inUploadsDir reports whether a cleaned request path lies inside -uploads-dir
+func inUploadsDir(path string) bool {
+	if *uploadsDir == "" {
+		return false
+	}
+	dir := filepath.Clean(*uploadsDir)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func handlePost(conn net.Conn, req *http.Request) {
+	// Without a length or chunked framing we cannot tell where the body ends
+	if *requireLength && req.Header.Get("Content-Length") == "" && !isChunked(req) {
+		warnf("Upload to %s has no Content-Length", req.URL.Path)
+		sendClosingError(conn, http.StatusLengthRequired, "")
+		return
+	}
+
+	// Uploads have their own, smaller concurrency limit to protect disk I/O
+	if uploadSem != nil {
+		select {
+		case uploadSem <- struct{}{}:
+			defer func() { <-uploadSem }()
+		default:
+			warnf("All %d upload slots are busy", cap(uploadSem))
+			sendErrorResponse(conn, http.StatusServiceUnavailable, "")
+			return
+		}
+	}
+
+	// Bodies over -max-body-size are refused up front when their length is
+	// declared, and cut off once they exceed it otherwise
+	if *maxBodySize > 0 {
+		if req.ContentLength > *maxBodySize {
+			warnf("Upload to %s of %d bytes is over the limit of %d", req.URL.Path, req.ContentLength, *maxBodySize)
+			sendClosingError(conn, http.StatusRequestEntityTooLarge, "")
+			return
+		}
+		req.Body = http.MaxBytesReader(nil, req.Body, *maxBodySize)
+	}
+
+	// Slow-body defence: the client must keep up a minimum average rate
+	if *minUploadRate > 0 {
+		req.Body = newMinRateReader(req.Body, conn)
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	// Drop-box uploads never write to client-controlled paths
+	if *uploadMode == "spool" {
+		if req.Method == "PUT" {
+			warnf("PUT to %s refused in spool mode", req.URL.Path)
+			sendMethodNotAllowed(conn, req)
+			return
+		}
+		handleSpoolUpload(conn, req)
+		return
+	}
+
+	// step 1: Similarly resolve the path
+	rel, err := resolvePath(req.URL.Path)
+	if err != nil {
+		warnf("Rejecting path %q: %v", req.URL.Path, err)
+		sendErrorResponse(conn, http.StatusBadRequest, "")
+		return
+	}
+	root, path, alias := requestFile(req, rel)
+	if alias != nil && !alias.writable {
+		warnf("Upload to read-only alias %s refused", alias.prefix)
+		sendMethodNotAllowed(conn, req)
+		return
+	}
+	if !insideRoot(root, path) {
+		warnf("Refusing upload to %s: it leads outside the document root", path)
+		sendErrorResponse(conn, http.StatusForbidden, "")
+		return
+	}
+
+	// A browser form posts its files in a multipart envelope: store each of
+	// them in the directory named by the path
+	if mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); req.Method == "POST" && err == nil && mediaType == "multipart/form-data" {
+		handleMultipartUpload(conn, req, rel, path, params["boundary"])
+		return
+	}
+
+	// Conditional write: If-Match must name the target's current ETag, and
+	// If-None-Match: * only allows creating a new file
+	info, statErr := os.Stat(path)
+	existed := statErr == nil && !info.IsDir()
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !existed || !etagListMatches(ifMatch, etagFunc(info, path), false) {
+			warnf("If-Match %q does not match %s", ifMatch, path)
+			sendErrorResponse(conn, http.StatusPreconditionFailed, "")
+			return
+		}
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if existed && etagListMatches(ifNoneMatch, etagFunc(info, path), true) {
+			warnf("If-None-Match %q matches existing %s", ifNoneMatch, path)
+			sendErrorResponse(conn, http.StatusPreconditionFailed, "")
+			return
+		}
+	}
+
+	// step 2: Ensure directory exists
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		errorf("Failed to create directory: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+
+	// A Content-Range header resumes an upload at an offset instead of replacing the file
+	if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+		handleRangedUpload(conn, req, path, contentRange)
+		return
+	}
+
+	// step 3: Create a temporary file that replaces the target once complete
+	file, err := createUpload(path)
+	if err != nil {
+		errorf("Failed to create file: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	defer file.abort()
+
+	// step 4: Write request body (req.Body) to file
+	bytesCopied, err := io.Copy(file, req.Body)
+	if err != nil {
+		sendUploadError(conn, err)
+		return
+	}
+	if err := file.commit(); err != nil {
+		errorf("Failed to save file: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+
+	debugf("Successfully %sed %d bytes to %s", req.Method, bytesCopied, path)
+
+	// step 5: Send 201 Created, or 204 No Content when PUT replaced a file,
+	// with the ETag the stored file is now served with
+	etag := ""
+	if info, err := os.Stat(path); err == nil {
+		etag = etagFunc(info, path)
+	}
+	if req.Method == "PUT" && existed {
+		writeStatusLine(conn, http.StatusNoContent)
+	} else {
+		writeStatusLine(conn, http.StatusCreated)
+		fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+		fmt.Fprintf(conn, "Content-Length: 0\r\n")
+	}
+	if etag != "" {
+		fmt.Fprintf(conn, "ETag: %s\r\n", etag)
+	}
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n")
+}
+
+// htpasswdUsers maps the users of -htpasswd to their password hashes, nil
+// when authentication is off
+var htpasswdUsers map[string]string
+
+// loadHtpasswd reads "user:hash" lines. Hashes may be Apache MD5 ($apr1$),
+// {SHA} or plain text; bcrypt needs a library this server does without
+func loadHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: not user:hash", path, line)
+		}
+		if strings.HasPrefix(hash, "$2") {
+			warnf("%s:%d: bcrypt hash of %s is not supported, the user cannot log in", path, line, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// requiresAuth reports whether a URL path falls under one of -auth-paths
+func requiresAuth(urlPath string) bool {
+	clean := filepath.ToSlash(filepath.Clean("/" + urlPath))
+	for _, prefix := range strings.Split(*authPaths, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix != "" && pathHasPrefix(clean, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectTarget is where a -redirects entry sends the client, and with which status
+type redirectTarget struct {
+	url  string
+	code int
+}
+
+// redirectMap holds the -redirects entries: exact paths, and prefixes whose
+// target gets the rest of the path appended
+type redirectMap struct {
+	exact    map[string]redirectTarget
+	prefixes map[string]redirectTarget
+}
+
+// redirects is the loaded -redirects map, empty when there is none
+var redirects redirectMap
+
+// loadRedirects reads "path target [status]" lines with # comments. A path
+// ending in /* is a prefix; the status is 301 (default), 302, 307 or 308
+func loadRedirects(path string) (redirectMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return redirectMap{}, err
+	}
+	defer file.Close()
+
+	m := redirectMap{exact: make(map[string]redirectTarget), prefixes: make(map[string]redirectTarget)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 || !strings.HasPrefix(fields[0], "/") {
+			return redirectMap{}, fmt.Errorf("%s:%d: expected /path target [status]", path, line)
+		}
+		target := redirectTarget{url: fields[1], code: http.StatusMovedPermanently}
+		if len(fields) == 3 {
+			code, err := strconv.Atoi(fields[2])
+			if err != nil || (code != 301 && code != 302 && code != 307 && code != 308) {
+				return redirectMap{}, fmt.Errorf("%s:%d: status must be 301, 302, 307 or 308", path, line)
+			}
+			target.code = code
+		}
+		if prefix, ok := strings.CutSuffix(fields[0], "/*"); ok {
+			m.prefixes[prefix+"/"] = target
+		} else {
+			m.exact[fields[0]] = target
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return redirectMap{}, err
+	}
+	return m, nil
+}
+
+// lookup finds the redirect for a URL: its exact path, else the longest
+// matching prefix. The query string is passed on
+func (m redirectMap) lookup(u *url.URL) (string, int, bool) {
+	if len(m.exact) == 0 && len(m.prefixes) == 0 {
+		return "", 0, false
+	}
+	target, ok := m.exact[u.Path]
+	location := target.url
+	if !ok {
+		best := ""
+		for prefix, prefixTarget := range m.prefixes {
+			if strings.HasPrefix(u.Path, prefix) && len(prefix) > len(best) {
+				best, target, ok = prefix, prefixTarget, true
+			}
+		}
+		if !ok {
+			return "", 0, false
+		}
+		location = strings.TrimSuffix(target.url, "/") + "/" + strings.TrimPrefix(u.Path, best)
+	}
+	if u.RawQuery != "" && !strings.Contains(location, "?") {
+		location += "?" + u.RawQuery
+	}
+	return location, target.code, true
+}
+
+// rewriteRule is one line of -rewrite-rules. A code of 0 rewrites the path
+// internally, 301 or 302 redirects the client
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	code        int
+}
+
+// rewrites are the loaded -rewrite-rules, in file order
+var rewrites []rewriteRule
+
+// loadRewriteRules reads "regex replacement [redirect|permanent]" lines, with
+// # comments. The replacement may use $1 for the regex's groups
+func loadRewriteRules(path string) ([]rewriteRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []rewriteRule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected regex replacement [redirect|permanent]", path, line)
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rule := rewriteRule{pattern: pattern, replacement: fields[1]}
+		if len(fields) == 3 {
+			switch fields[2] {
+			case "redirect":
+				rule.code = http.StatusFound
+			case "permanent":
+				rule.code = http.StatusMovedPermanently
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown flag %q", path, line, fields[2])
+			}
+		}
+		if rule.code == 0 && !strings.HasPrefix(rule.replacement, "/") {
+			return nil, fmt.Errorf("%s:%d: an internal rewrite must produce a path", path, line)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// applyRewrites applies the first rewrite rule matching the request path.
+// It reports true when it answered the request with a redirect; an internal
+// rewrite changes req.URL and lets the request carry on. The original query
+// is kept unless the replacement brings its own
+func applyRewrites(conn net.Conn, req *http.Request) bool {
+	for _, rule := range rewrites {
+		match := rule.pattern.FindStringSubmatchIndex(req.URL.Path)
+		if match == nil {
+			continue
+		}
+		target := string(rule.pattern.ExpandString(nil, rule.replacement, req.URL.Path, match))
+		if !strings.Contains(target, "?") && req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		if rule.code != 0 {
+			sendRedirect(conn, rule.code, target)
+			return true
+		}
+		targetPath, query, _ := strings.Cut(target, "?")
+		debugf("Rewriting %s to %s", req.URL.Path, target)
+		req.URL.Path, req.URL.RawPath, req.URL.RawQuery = targetPath, "", query
+		return false
+	}
+	return false
+}
+
+// pathHasPrefix reports whether a cleaned URL path is prefix or lies below it
+func pathHasPrefix(clean, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || clean == prefix || strings.HasPrefix(clean, prefix+"/")
+}
+
+// corsRule is one -cors entry: the origins allowed below a path prefix
+type corsRule struct {
+	prefix  string
+	origins []string
+}
+
+// anyOrigin reports whether the rule allows every origin
+func (r *corsRule) anyOrigin() bool {
+	for _, allowed := range r.origins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// corsRules are the parsed -cors entries
+var corsRules []corsRule
+
+// parseCORS parses -cors "prefix=origin origin,prefix=*"
+func parseCORS(value string) ([]corsRule, error) {
+	var rules []corsRule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, origins, ok := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || !strings.HasPrefix(prefix, "/") || len(strings.Fields(origins)) == 0 {
+			return nil, fmt.Errorf("%q is not /prefix=origins", entry)
+		}
+		rules = append(rules, corsRule{prefix: prefix, origins: strings.Fields(origins)})
+	}
+	return rules, nil
+}
+
+// corsRuleFor returns the -cors rule with the longest prefix matching a URL
+// path, nil when none does
+func corsRuleFor(path string) *corsRule {
+	clean := filepath.ToSlash(filepath.Clean("/" + path))
+	var best *corsRule
+	for i, rule := range corsRules {
+		if pathHasPrefix(clean, rule.prefix) && (best == nil || len(rule.prefix) > len(best.prefix)) {
+			best = &corsRules[i]
+		}
+	}
+	return best
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin for a request under
+// rule: "*", its Origin, or "" when the rule does not allow it
+func corsOrigin(req *http.Request, rule *corsRule) string {
+	origin := req.Header.Get("Origin")
+	if origin == "" || rule == nil {
+		return ""
+	}
+	for _, allowed := range rule.origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// sendPreflight answers a CORS preflight with what the actual request may use
+func sendPreflight(conn net.Conn, req *http.Request, origin string) {
+	headers := *corsHeaders
+	if headers == "" {
+		headers = req.Header.Get("Access-Control-Request-Headers")
+	}
+	writeStatusLine(conn, http.StatusNoContent)
+	fmt.Fprintf(conn, "Access-Control-Allow-Origin: %s\r\n", origin)
+	fmt.Fprintf(conn, "Access-Control-Allow-Methods: %s\r\n", allowedMethods(req))
+	if headers != "" {
+		fmt.Fprintf(conn, "Access-Control-Allow-Headers: %s\r\n", headers)
+	}
+	fmt.Fprintf(conn, "Access-Control-Max-Age: %d\r\n", int64(corsMaxAge.Seconds()))
+	// A cached preflight must not be reused for another origin, or for other
+	// requested headers when those are echoed back
+	var vary []string
+	if origin != "*" {
+		vary = append(vary, "Origin")
+	}
+	if *corsHeaders == "" {
+		vary = append(vary, "Access-Control-Request-Headers")
+	}
+	if len(vary) > 0 {
+		fmt.Fprintf(conn, "Vary: %s\r\n", strings.Join(vary, ", "))
+	}
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n")
+}
+
+// authorized checks the request's Basic credentials against -htpasswd
+func authorized(req *http.Request) bool {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, found := htpasswdUsers[user]
+	if !found {
+		return false
+	}
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		computed = apr1Hash(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$"):
+		return false // crypt formats we cannot check, such as bcrypt
+	default:
+		computed = password
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1Hash computes Apache's MD5-based "$apr1$salt$hash" for a password
+func apr1Hash(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	digest := md5.New()
+	digest.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		digest.Write(alternate[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write(pw[:1])
+		}
+	}
+	final := digest.Sum(nil)
+
+	// 1000 rounds to slow down brute force
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	// Encode in the crypt base64 alphabet and byte order
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + out.String()
+}
+
+// sendUnauthorized is a helper function to send 401 with a Basic challenge
+func sendUnauthorized(conn net.Conn) {
+	body := fmt.Sprintf("%d %s", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+	writeStatusLine(conn, http.StatusUnauthorized)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "WWW-Authenticate: Basic realm=%q, charset=\"UTF-8\"\r\n", *authRealm)
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// jwtHMACKey and jwtRSAKey hold the -jwt-key, only one of them is set
+var (
+	jwtHMACKey []byte
+	jwtRSAKey  *rsa.PublicKey
+)
+
+// loadJWTKey reads -jwt-key: a PEM public key is used for RS256, anything
+// else is taken as the HS256 secret
+func loadJWTKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s is not an RSA public key", path)
+		}
+		jwtRSAKey = rsaKey
+		return nil
+	}
+	if jwtHMACKey = bytes.TrimSpace(data); len(jwtHMACKey) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	return nil
+}
+
+// writeMethod reports whether a method changes files
+func writeMethod(method string) bool {
+	return method == "POST" || method == "PUT" || method == "DELETE"
+}
+
+// verifyBearer checks the request's "Authorization: Bearer" JWT: its signature
+// against -jwt-key (the token's alg must match the key type) and its exp and nbf
+func verifyBearer(req *http.Request) error {
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return errors.New("no bearer token")
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return errors.New("malformed token header")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(claimsJSON, &claims) != nil {
+		return errors.New("malformed token claims")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed token signature")
+	}
+
+	// step 1: The signature, with the algorithm the key is meant for
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && jwtHMACKey != nil:
+		mac := hmac.New(sha256.New, jwtHMACKey)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("bad signature")
+		}
+	case header.Alg == "RS256" && jwtRSAKey != nil:
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(jwtRSAKey, crypto.SHA256, sum[:], signature); err != nil {
+			return errors.New("bad signature")
+		}
+	default:
+		return fmt.Errorf("unexpected alg %q", header.Alg)
+	}
+
+	// step 2: The validity period
+	now := float64(time.Now().Unix())
+	if claims.Exp != nil && now >= *claims.Exp {
+		return errors.New("token expired")
+	}
+	if claims.Nbf != nil && now < *claims.Nbf {
+		return errors.New("token not yet valid")
+	}
+	return nil
+}
+
+// sendBearerChallenge is a helper function to send 401 asking for a bearer token
+func sendBearerChallenge(conn net.Conn) {
+	body := fmt.Sprintf("%d %s", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+	writeStatusLine(conn, http.StatusUnauthorized)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "WWW-Authenticate: Bearer realm=%q, error=\"invalid_token\"\r\n", *authRealm)
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// allowedMethods lists the methods accepted for the request's path, or for the
+// server as a whole when the target is "*" (or not a valid path)
+func allowedMethods(req *http.Request) string {
+	methods := []string{"OPTIONS", "GET", "HEAD"}
+	rel, err := resolvePath(req.URL.Path)
+	if alias := aliasFor(rel); req.URL.Path != "*" && err == nil && alias != nil && !alias.writable {
+		return strings.Join(methods, ", ")
+	}
+	methods = append(methods, "POST")
+	if *uploadMode != "spool" {
+		methods = append(methods, "PUT")
+	}
+	if *allowDelete {
+		if req.URL.Path == "*" || err != nil || *uploadsDir == "" || inUploadsDir(rel) {
+			methods = append(methods, "DELETE")
+		}
+	}
+	return strings.Join(methods, ", ")
+}
+
+// handleOptions answers OPTIONS, for "*" or a path, with the allowed methods
+func handleOptions(conn net.Conn, req *http.Request) {
+	writeStatusLine(conn, http.StatusOK)
+	fmt.Fprintf(conn, "Allow: %s\r\n", allowedMethods(req))
+	fmt.Fprintf(conn, "Content-Length: 0\r\n")
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n")
+}
+
+// sendMethodNotAllowed is a helper function to send 405 for a method this
+// server knows but does not accept here, listing the ones it does
+func sendMethodNotAllowed(conn net.Conn, req *http.Request) {
+	body := fmt.Sprintf("%d %s", http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	writeStatusLine(conn, http.StatusMethodNotAllowed)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Allow: %s\r\n", allowedMethods(req))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// handleDelete removes the file at the request path. With -uploads-dir set only
+// files inside it may be removed; directories are never removed
+func handleDelete(conn net.Conn, req *http.Request) {
+	// step 1: Resolve the path like any other request
+	rel, err := resolvePath(req.URL.Path)
+	if err != nil {
+		warnf("Rejecting path %q: %v", req.URL.Path, err)
+		sendErrorResponse(conn, http.StatusBadRequest, "")
+		return
+	}
+	if *uploadsDir != "" && !inUploadsDir(rel) {
+		warnf("DELETE outside %s refused: %s", *uploadsDir, rel)
+		sendErrorResponse(conn, http.StatusForbidden, "")
+		return
+	}
+	root, path, alias := requestFile(req, rel)
+	if alias != nil && !alias.writable {
+		warnf("DELETE in read-only alias %s refused", alias.prefix)
+		sendMethodNotAllowed(conn, req)
+		return
+	}
+	if !insideRoot(root, path) {
+		warnf("DELETE of %s refused: it leads outside the document root", path)
+		sendErrorResponse(conn, http.StatusForbidden, "")
+		return
+	}
+
+	// step 2: The target must be an existing file, matching If-Match if given
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		sendErrorResponse(conn, http.StatusNotFound, "")
+		return
+	}
+	if err != nil || info.IsDir() {
+		warnf("DELETE of %s refused: not a file", path)
+		sendErrorResponse(conn, http.StatusForbidden, "")
+		return
+	}
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && !etagListMatches(ifMatch, etagFunc(info, path), false) {
+		warnf("If-Match %q does not match %s", ifMatch, path)
+		sendErrorResponse(conn, http.StatusPreconditionFailed, "")
+		return
+	}
+
+	// step 3: Remove it and answer 204 No Content
+	if err := os.Remove(path); err != nil {
+		errorf("Failed to delete %s: %v", path, err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	infof("Deleted %s", path)
+	writeStatusLine(conn, http.StatusNoContent)
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n")
+}
+
+// formFile is one stored file in the JSON summary of a multipart upload
+type formFile struct {
+	Field string `json:"field"`
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// handleMultipartUpload stores the file parts of a multipart/form-data body in
+// the directory dir, under their sanitized file names. Nothing is replaced
+// unless the whole body is read successfully
+func handleMultipartUpload(conn net.Conn, req *http.Request, rel, dir, boundary string) {
+	if boundary == "" {
+		sendErrorResponse(conn, http.StatusBadRequest, "Missing multipart boundary")
+		return
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		warnf("Multipart upload target %s is a file", dir)
+		sendErrorResponse(conn, http.StatusConflict, "Target is not a directory")
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		errorf("Failed to create directory: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+
+	// step 1: Write every file part to a temporary file
+	var files []*uploadFile
+	defer func() {
+		for _, file := range files {
+			file.abort()
+		}
+	}()
+	var stored []formFile
+	reader := multipart.NewReader(req.Body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			var ne net.Error
+			if errors.As(err, &tooLarge) || (errors.As(err, &ne) && ne.Timeout()) {
+				sendUploadError(conn, err)
+			} else {
+				warnf("Malformed multipart body: %v", err)
+				sendClosingError(conn, http.StatusBadRequest, "Malformed multipart body")
+			}
+			return
+		}
+		name := sanitizeFileName(part.FileName())
+		if name == "" {
+			part.Close() // an ordinary form field, or no usable name
+			continue
+		}
+		if len(files) == *maxFormFiles {
+			warnf("Multipart upload has more than %d files", *maxFormFiles)
+			sendClosingError(conn, http.StatusRequestEntityTooLarge, "Too many files")
+			return
+		}
+		file, err := createUpload(filepath.Join(dir, name))
+		if err != nil {
+			errorf("Failed to create file: %v", err)
+			sendErrorResponse(conn, http.StatusInternalServerError, "")
+			return
+		}
+		files = append(files, file)
+		n, err := io.Copy(file, part)
+		if err != nil {
+			sendUploadError(conn, err)
+			return
+		}
+		stored = append(stored, formFile{
+			Field: part.FormName(),
+			Name:  name,
+			Path:  "/" + filepath.ToSlash(filepath.Join(rel, name)),
+			Bytes: n,
+		})
+	}
+	if len(files) == 0 {
+		sendErrorResponse(conn, http.StatusBadRequest, "No files in form")
+		return
+	}
+
+	// step 2: Move them into place, a later part with the same name winning
+	for _, file := range files {
+		if err := file.commit(); err != nil {
+			errorf("Failed to save file: %v", err)
+			sendErrorResponse(conn, http.StatusInternalServerError, "")
+			return
+		}
+	}
+	debugf("Stored %d file(s) from a form in %s", len(files), dir)
+
+	// step 3: Send 201 Created with what was stored
+	body, _ := json.Marshal(struct {
+		Files []formFile `json:"files"`
+	}{stored})
+	writeStatusLine(conn, http.StatusCreated)
+	fmt.Fprintf(conn, "Content-Type: application/json\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	conn.Write(body)
+}
+
+// sanitizeFileName reduces a client-supplied file name to a plain name inside
+// the target directory, or "" when nothing usable is left
+func sanitizeFileName(name string) string {
+	name = name[strings.LastIndexAny(name, `/\`)+1:] // browsers may send a full path
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" || len(name) > 255 {
+		return ""
+	}
+	return name
+}
+
+// serveAcmeChallenge serves an ACME HTTP-01 token from -acme-webroot as text/plain
+func serveAcmeChallenge(conn net.Conn, req *http.Request) {
+	// step 1: The token must be a single base64url segment
+	token := strings.TrimPrefix(req.URL.Path, *acmePath)
+	if token == "" || strings.Trim(token, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		warnf("Invalid ACME challenge token: %q", token)
+		sendErrorResponse(conn, http.StatusNotFound, "")
+		return
+	}
+
+	// step 2: Read the token file the ACME client left in the webroot
+	path := filepath.Join(*acmeWebroot, filepath.FromSlash(req.URL.Path))
+	body, err := os.ReadFile(path)
+	if err != nil {
+		warnf("ACME challenge not found: %s", path)
+		sendErrorResponse(conn, http.StatusNotFound, "")
+		return
+	}
+	debugf("Serving ACME challenge %s", token)
+
+	// step 3: Send it back as plain text
+	writeStatusLine(conn, http.StatusOK)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	conn.Write(body)
+}
+
+// watchRoot periodically re-validates the document root
+func watchRoot(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkRoot()
+	}
+}
+
+// checkRoot reports whether the document root still exists, switching into
+// or out of degraded mode when that changes
+func checkRoot() bool {
+	info, err := os.Stat(rootDir)
+	available := err == nil && info.IsDir()
+	if available && !rootAvailable.Load() {
+		// Enter the directory again in case it was re-created or re-mounted
+		if err := os.Chdir(rootDir); err != nil {
+			warnf("Document root %s is back but cannot be entered: %v", rootDir, err)
+			return false
+		}
+		infof("Document root %s is available again", rootDir)
+	}
+	if !available && rootAvailable.Load() {
+		warnf("Document root %s is unavailable, answering 503 until it returns", rootDir)
+	}
+	rootAvailable.Store(available)
+	return available
+}
+
+// healthReport is the JSON health payload
+type healthReport struct {
+	Status            string            `json:"status"`
+	UptimeSeconds     int64             `json:"uptime_seconds"`
+	ActiveConnections int64             `json:"active_connections"`
+	Checks            map[string]string `json:"checks"`
+}
+
+// checkHealth runs the subsystem checks, each reporting "ok" or what is wrong
+func checkHealth() healthReport {
+	report := healthReport{
+		Status:            "ok",
+		UptimeSeconds:     int64(time.Since(startTime).Seconds()),
+		ActiveConnections: activeConnections.Load(),
+		Checks:            make(map[string]string),
+	}
+
+	// The document root must exist and be readable
+	report.Checks["document_root"] = "ok"
+	if !checkRoot() {
+		report.Checks["document_root"] = "unavailable"
+	} else if dir, err := os.Open("."); err != nil {
+		report.Checks["document_root"] = err.Error()
+	} else {
+		if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+			report.Checks["document_root"] = err.Error()
+		}
+		dir.Close()
+	}
+
+	// Uploads need free disk space, where the platform can tell how much is left
+	report.Checks["disk_space"] = "ok"
+	if free, err := freeDiskSpace("."); errors.Is(err, errors.ErrUnsupported) {
+		report.Checks["disk_space"] = "unknown"
+	} else if err != nil {
+		report.Checks["disk_space"] = err.Error()
+	} else if free < *healthMinFree {
+		report.Checks["disk_space"] = fmt.Sprintf("only %d bytes free", free)
+	}
+
+	for _, result := range report.Checks {
+		if result != "ok" && result != "unknown" {
+			report.Status = "unhealthy"
+		}
+	}
+	return report
+}
+
+// serveHealth answers health probes with "ok", or a JSON report when the client accepts JSON.
+// Failing checks turn the response into 503 so load balancers take the instance out.
+func serveHealth(conn net.Conn, req *http.Request) {
+	report := checkHealth()
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+		warnf("Health check failed: %v", report.Checks)
+	}
+
+	contentType := "text/plain"
+	body := []byte(report.Status)
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		contentType = "application/json"
+		body, _ = json.Marshal(report)
+	}
+
+	writeStatusLine(conn, code)
+	fmt.Fprintf(conn, "Content-Type: %s\r\n", contentType)
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Cache-Control: no-store\r\n")
+	fmt.Fprintf(conn, "Vary: Accept\r\n")
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	conn.Write(body)
+}
+
+// hitCounter counts requests per path, tracking at most -stats-max-paths
+// distinct paths and lumping the rest together as "other"
+type hitCounter struct {
+	mu    sync.Mutex
+	hits  map[string]int64
+	other int64
+}
+
+// record counts a hit for a path as returned by resolvePath
+func (c *hitCounter) record(path string) {
+	key := "/" + filepath.ToSlash(path)
+	if path == "." {
+		key = "/"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.hits[key]; ok || len(c.hits) < *statsMaxPaths {
+		c.hits[key]++
+	} else {
+		c.other++
+	}
+}
+
+// pathCount is one entry of the top paths list
+type pathCount struct {
+	Path string `json:"path"`
+	Hits int64  `json:"hits"`
+}
+
+// top returns the n most requested paths and the hits counted as "other"
+func (c *hitCounter) top(n int) ([]pathCount, int64) {
+	c.mu.Lock()
+	counts := make([]pathCount, 0, len(c.hits))
+	for path, hits := range c.hits {
+		counts = append(counts, pathCount{Path: path, Hits: hits})
+	}
+	other := c.other
+	c.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Hits != counts[j].Hits {
+			return counts[i].Hits > counts[j].Hits
+		}
+		return counts[i].Path < counts[j].Path
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts, other
+}
+
+// defaultStatsTop is how many paths the statistics endpoint lists unless ?top= says otherwise
+const defaultStatsTop = 20
+
+// serverStats is the JSON statistics payload
+type serverStats struct {
+	UptimeSeconds     int64       `json:"uptime_seconds"`
+	ActiveConnections int64       `json:"active_connections"`
+	ConnectionLimit   int64       `json:"connection_limit"`
+	Queued            int64       `json:"queued_connections"`
+	Rejected          int64       `json:"rejected_connections"`
+	CacheHits         int64       `json:"cache_hits"`
+	CacheMisses       int64       `json:"cache_misses"`
+	CacheBytes        int64       `json:"cache_bytes"`
+	TopPaths          []pathCount `json:"top_paths"`
+	OtherHits         int64       `json:"other_hits"`
+}
+
+// serveStats sends the statistics as JSON, listing the ?top=N most requested paths
+func serveStats(conn net.Conn, req *http.Request) {
+	n := defaultStatsTop
+	if value := req.URL.Query().Get("top"); value != "" {
+		if v, err := strconv.Atoi(value); err == nil && v > 0 {
+			n = v
+		}
+	}
+	stats := serverStats{
+		UptimeSeconds:     int64(time.Since(startTime).Seconds()),
+		ActiveConnections: activeConnections.Load(),
+		ConnectionLimit:   connectionLimit.Load(),
+		Queued:            queuedConnections.Load(),
+		Rejected:          rejectedConnections.Load(),
+	}
+	if fileCache != nil {
+		stats.CacheHits, stats.CacheMisses, stats.CacheBytes = fileCache.counters()
+	}
+	stats.TopPaths, stats.OtherHits = pathHits.top(n)
+	body, _ := json.MarshalIndent(stats, "", "  ")
+
+	writeStatusLine(conn, http.StatusOK)
+	fmt.Fprintf(conn, "Content-Type: application/json\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Cache-Control: no-store\r\n")
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	conn.Write(body)
+}
+
+// rootBehavior describes how "/" is answered
+type rootBehavior struct {
+	mode   string // "index", "listing", "redirect" or "status"
+	target string // redirect location
+	code   int    // redirect or response status code
+}
+
+// parseRootBehavior parses "index", "listing", "redirect=[301:]<url>" or "status=<code>"
+func parseRootBehavior(value string) (rootBehavior, error) {
+	mode, arg, _ := strings.Cut(value, "=")
+	switch mode {
+	case "index", "listing":
+		return rootBehavior{mode: mode}, nil
+	case "redirect":
+		code := http.StatusFound
+		if prefix, rest, ok := strings.Cut(arg, ":"); ok && len(prefix) == 3 {
+			if c, err := strconv.Atoi(prefix); err == nil {
+				if c < 300 || c > 399 {
+					return rootBehavior{}, fmt.Errorf("%d is not a redirect status", c)
+				}
+				code, arg = c, rest
+			}
+		}
+		if arg == "" {
+			return rootBehavior{}, fmt.Errorf("missing redirect target")
+		}
+		return rootBehavior{mode: "redirect", target: arg, code: code}, nil
+	case "status":
+		code, err := strconv.Atoi(arg)
+		if err != nil || code < 200 || code > 599 || http.StatusText(code) == "" {
+			return rootBehavior{}, fmt.Errorf("invalid status %q", arg)
+		}
+		return rootBehavior{mode: "status", code: code}, nil
+	}
+	return rootBehavior{}, fmt.Errorf("unknown mode %q", mode)
+}
+
+// serveRootBehavior answers "/" with the configured redirect or status
+func serveRootBehavior(conn net.Conn) {
+	code := rootConfig.code
+	body := fmt.Sprintf("%d %s", code, http.StatusText(code))
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		body = ""
+	}
+	debugf("Answering / with %d", code)
+	if rootConfig.mode == "redirect" {
+		sendRedirect(conn, code, rootConfig.target)
+		return
+	}
+
+	writeStatusLine(conn, code)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// serveListing answers a directory request with an HTML table of its
+// entries. Hidden files are left out. Last-Modified is the newest of the
+// directory's modification time, which changes when entries are added or
+// removed, and those of the listed entries, whose sizes and times are shown
+func serveListing(conn net.Conn, req *http.Request, dir string) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		errorf("Failed to stat directory %s: %v", dir, err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	body, lastModified, err := listingBody(dir, req.URL.Path, info.ModTime())
+	if err != nil {
+		errorf("Failed to list directory %s: %v", dir, err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	if notModified(req, lastModified, "") {
+		sendNotModified(conn, header, "")
+		return
+	}
+
+	w := newResponseWriter(conn, req, http.StatusOK, header)
+	w.Write(body)
+	if err := w.Close(); err != nil {
+		warnf("Failed to send listing of %s: %v", dir, err)
+		w.Abort()
+	}
+}
+
+// listingCache holds generated listings for -listing-cache-ttl, by directory and URL path
+var listingCache = struct {
+	mu      sync.Mutex
+	entries map[string]cachedListing
+}{entries: make(map[string]cachedListing)}
+
+// cachedListing is a generated listing and the directory state it reflects
+type cachedListing struct {
+	body         []byte
+	modTime      time.Time
+	lastModified time.Time
+	generated    time.Time
+}
+
+// listingBody returns the HTML listing of dir and its Last-Modified time,
+// reusing one generated within -listing-cache-ttl as long as the directory's
+// modification time is unchanged
+func listingBody(dir, urlPath string, modTime time.Time) ([]byte, time.Time, error) {
+	if *listingCacheTTL <= 0 {
+		return renderListing(dir, urlPath, modTime)
+	}
+	key := dir + "\x00" + urlPath
+	listingCache.mu.Lock()
+	cached, ok := listingCache.entries[key]
+	listingCache.mu.Unlock()
+	if ok && cached.modTime.Equal(modTime) && time.Since(cached.generated) < *listingCacheTTL {
+		return cached.body, cached.lastModified, nil
+	}
+
+	body, lastModified, err := renderListing(dir, urlPath, modTime)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	now := time.Now()
+	listingCache.mu.Lock()
+	defer listingCache.mu.Unlock()
+	for k, entry := range listingCache.entries {
+		if now.Sub(entry.generated) >= *listingCacheTTL {
+			delete(listingCache.entries, k)
+		}
+	}
+	listingCache.entries[key] = cachedListing{body: body, modTime: modTime, lastModified: lastModified, generated: now}
+	return body, lastModified, nil
+}
+
+// renderListing generates the HTML listing of dir, served at urlPath, and
+// returns it with the newest of modTime and the listed entries' times
+func renderListing(dir, urlPath string, modTime time.Time) ([]byte, time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	lastModified := modTime
+	debugf("Listing directory %s (%d entries)", dir, len(entries))
+
+	var w bytes.Buffer
+	title := html.EscapeString(urlPath)
+	fmt.Fprintf(&w, "<html><head><title>Index of %s</title></head><body><h1>Index of %s</h1>\n", title, title)
+	fmt.Fprintf(&w, "<table><tr><th>Name</th><th>Size</th><th>Modified</th></tr>\n")
+	if urlPath != "/" {
+		fmt.Fprintf(&w, "<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		entryInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if entryInfo.ModTime().After(lastModified) {
+			lastModified = entryInfo.ModTime()
+		}
+		size := strconv.FormatInt(entryInfo.Size(), 10)
+		link := url.PathEscape(name)
+		if entry.IsDir() {
+			name, link, size = name+"/", link+"/", "-"
+		}
+		fmt.Fprintf(&w, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(link), html.EscapeString(name), size, entryInfo.ModTime().UTC().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(&w, "</table></body></html>\n")
+	return w.Bytes(), lastModified, nil
+}
+
+// sitemapCache holds the last generated sitemap so the tree is not walked on every request
+var sitemapCache struct {
+	mu        sync.Mutex
+	body      []byte
+	generated time.Time
+}
+
+// sitemapURLSet is the <urlset> document of the sitemap protocol
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// serveSitemap sends the sitemap, regenerating it once the cached copy is older than -sitemap-ttl
+func serveSitemap(conn net.Conn) {
+	sitemapCache.mu.Lock()
+	if sitemapCache.body == nil || time.Since(sitemapCache.generated) > *sitemapTTL {
+		body, err := generateSitemap(".")
+		if err != nil {
+			sitemapCache.mu.Unlock()
+			errorf("Failed to generate sitemap: %v", err)
+			sendErrorResponse(conn, http.StatusInternalServerError, "")
+			return
+		}
+		sitemapCache.body = body
+		sitemapCache.generated = time.Now()
+		debugf("Generated sitemap (%d bytes)", len(body))
+	}
+	body := sitemapCache.body
+	sitemapCache.mu.Unlock()
+
+	writeStatusLine(conn, http.StatusOK)
+	fmt.Fprintf(conn, "Content-Type: application/xml\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	conn.Write(body)
+}
+
+// generateSitemap walks root and lists every .html file, skipping hidden files and directories
+func generateSitemap(root string) ([]byte, error) {
+	set := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	base := strings.TrimSuffix(*baseURL, "/")
+
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			warnf("Skipping %s in sitemap: %v", path, err)
+			return nil
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || filepath.Ext(path) != ".html" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     base + "/" + strings.Join(segments, "/"),
+			LastMod: info.ModTime().UTC().Format("2006-01-02"),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// minRateReader enforces -min-upload-rate by moving the connection's read deadline
+// forward in proportion to the bytes received so far
+type minRateReader struct {
+	body     io.ReadCloser
+	conn     net.Conn
+	start    time.Time
+	received int64
+}
+
+func newMinRateReader(body io.ReadCloser, conn net.Conn) *minRateReader {
+	r := &minRateReader{body: body, conn: conn, start: time.Now()}
+	conn.SetReadDeadline(r.deadline())
+	return r
+}
+
+func (r *minRateReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.received += int64(n)
+	r.conn.SetReadDeadline(r.deadline())
+	return n, err
+}
+
+func (r *minRateReader) Close() error {
+	return r.body.Close()
+}
+
+// deadline is the latest time the next bytes may arrive: the grace period plus
+// the time the bytes received so far are worth at the minimum rate
+func (r *minRateReader) deadline() time.Time {
+	earned := time.Duration(float64(r.received) / float64(*minUploadRate) * float64(time.Second))
+	return r.start.Add(*uploadGrace + earned)
+}
+
+// sendUploadError reports a failure while storing a request body: 408 when the
+// client was too slow, 413 when the body was too large, 500 otherwise. The
+// body is left partly read, so the connection is closed after the answer
+func sendUploadError(conn net.Conn, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		warnf("Upload over the limit of %d bytes, giving up", tooLarge.Limit)
+		sendClosingError(conn, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		warnf("Upload too slow, giving up: %v", err)
+		sendClosingError(conn, http.StatusRequestTimeout, "Upload too slow")
+		return
+	}
+	errorf("Failed to write to file: %v", err)
+	sendClosingError(conn, http.StatusInternalServerError, "")
+}
+
+// spoolUpload is the JSON body returned for a spooled upload
+type spoolUpload struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// handleSpoolUpload stores the body under a server-generated unique name in -spool-dir,
+// ignoring the request path
+func handleSpoolUpload(conn net.Conn, req *http.Request) {
+	// step 1: Generate a unique name: a timestamp plus random bytes
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		errorf("Failed to generate upload name: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	name := time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random)
+	path := filepath.Join(*spoolDir, name)
+
+	// step 2: Create a temporary file, mirrored into -backup-dir like any upload;
+	// the random name keeps the rename from replacing another upload
+	file, err := createUpload(path)
+	if err != nil {
+		errorf("Failed to create file: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	defer file.abort()
+
+	// step 3: Write request body (req.Body) to file
+	bytesCopied, err := io.Copy(file, req.Body)
+	if err != nil {
+		sendUploadError(conn, err)
+		return
+	}
+	if err := file.commit(); err != nil {
+		errorf("Failed to save file: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	debugf("Successfully spooled %d bytes to %s", bytesCopied, path)
+
+	// step 4: Send 201 Created with the generated location
+	location := "/" + filepath.ToSlash(path)
+	body, _ := json.Marshal(spoolUpload{Name: name, Path: location, Bytes: bytesCopied})
+	writeStatusLine(conn, http.StatusCreated)
+	fmt.Fprintf(conn, "Location: %s\r\n", location)
+	fmt.Fprintf(conn, "Content-Type: application/json\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n")
+	conn.Write(body)
+}
+
+// atomicFile is written under a temporary name next to its target and renamed
+// into place by commit, so readers never see a partial upload
+type atomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &atomicFile{File: file, path: path}, nil
+}
+
+// commit closes the temporary file and renames it over the target
+func (f *atomicFile) commit() error {
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	f.committed = true
+	return nil
+}
+
+// abort discards the temporary file unless it was committed
+func (f *atomicFile) abort() {
+	if !f.committed {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// uploadFile is an upload being written to a temporary file, mirrored into
+// -backup-dir when that is set
+type uploadFile struct {
+	file      *atomicFile
+	backup    *atomicFile
+	backupErr *softWriter // nil when -backup-required makes backup errors fatal
+	writer    io.Writer
+}
+
+// createUpload starts an upload to path and its backup copy. A backup that
+// cannot be created only fails the upload with -backup-required
+func createUpload(path string) (*uploadFile, error) {
+	file, err := createAtomic(path)
+	if err != nil {
+		return nil, err
+	}
+	upload := &uploadFile{file: file, writer: file}
+	if *backupDir == "" {
+		return upload, nil
+	}
+
+	backupPath := filepath.Join(*backupDir, path)
+	if err = os.MkdirAll(filepath.Dir(backupPath), 0755); err == nil {
+		upload.backup, err = createAtomic(backupPath)
+	}
+	if err != nil {
+		if *backupRequired {
+			file.abort()
+			return nil, fmt.Errorf("backup: %w", err)
+		}
+		errorf("Failed to create backup file: %v", err)
+		return upload, nil
+	}
+	if *backupRequired {
+		upload.writer = io.MultiWriter(file, upload.backup)
+	} else {
+		upload.backupErr = &softWriter{w: upload.backup}
+		upload.writer = io.MultiWriter(file, upload.backupErr)
+	}
+	return upload, nil
+}
+
+// Write writes p to the file and its backup in the same pass
+func (u *uploadFile) Write(p []byte) (int, error) {
+	return u.writer.Write(p)
+}
+
+// commit renames the file into place, then its backup. A failed backup is
+// only logged, as -backup-required already failed the writes
+func (u *uploadFile) commit() error {
+	if err := u.file.commit(); err != nil {
+		return err
+	}
+	if u.backup != nil {
+		if u.backupErr != nil && u.backupErr.err != nil {
+			warnf("Backup of %s failed: %v", u.file.path, u.backupErr.err)
+		} else if err := u.backup.commit(); err != nil {
+			warnf("Failed to save backup of %s: %v", u.file.path, err)
+		}
+	}
+	return nil
+}
+
+// abort discards whatever was not committed
+func (u *uploadFile) abort() {
+	u.file.abort()
+	if u.backup != nil {
+		u.backup.abort()
+	}
+}
+
+// softWriter keeps the first write error to itself, so a failing backup
+// does not abort the copy to the primary file
+type softWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *softWriter) Write(p []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// isChunked reports whether the request body uses chunked transfer encoding
+func isChunked(req *http.Request) bool {
+	for _, encoding := range req.TransferEncoding {
+		if encoding == "chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRangedUpload writes the request body at the offset given by a
+// "Content-Range: bytes start-end/total" header so clients can resume uploads
+func handleRangedUpload(conn net.Conn, req *http.Request, path, contentRange string) {
+	// step 1: Parse the range
+	start, end, total, err := parseContentRange(contentRange)
+	if err != nil {
+		warnf("Invalid Content-Range %q: %v", contentRange, err)
+		sendErrorResponse(conn, http.StatusBadRequest, "Invalid Content-Range")
+		return
+	}
+	length := end - start + 1
+	if *maxBodySize > 0 && end >= *maxBodySize {
+		warnf("Upload range %q reaches past the limit of %d bytes", contentRange, *maxBodySize)
+		sendClosingError(conn, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	if req.ContentLength >= 0 && req.ContentLength != length {
+		warnf("Content-Length %d does not match Content-Range %q", req.ContentLength, contentRange)
+		sendErrorResponse(conn, http.StatusBadRequest, "Content-Length does not match Content-Range")
+		return
+	}
+
+	// step 2: Open the file without truncating it
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		errorf("Failed to open file: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	defer file.Close()
+
+	// step 3: Refuse to leave a gap between the current end of the file and start
+	stat, err := file.Stat()
+	if err != nil {
+		errorf("Failed to get file stat: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	if start > stat.Size() {
+		warnf("Upload offset %d is beyond the end of %s (%d bytes)", start, path, stat.Size())
+		sendErrorResponse(conn, http.StatusRequestedRangeNotSatisfiable, "")
+		return
+	}
+
+	// step 4: Write the body at the offset
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		errorf("Failed to seek in file: %v", err)
+		sendErrorResponse(conn, http.StatusInternalServerError, "")
+		return
+	}
+	bytesCopied, err := io.Copy(file, io.LimitReader(req.Body, length))
+	if err != nil {
+		sendUploadError(conn, err)
+		return
+	}
+	if bytesCopied != length {
+		warnf("Short upload body: got %d of %d bytes", bytesCopied, length)
+		sendErrorResponse(conn, http.StatusBadRequest, "Body shorter than Content-Range")
+		return
+	}
+
+	// step 5: Drop stale bytes past the end once the last chunk arrives
+	if total >= 0 && end+1 == total && stat.Size() > total {
+		if err := file.Truncate(total); err != nil {
+			errorf("Failed to truncate file: %v", err)
+		}
+	}
+
+	debugf("Successfully wrote bytes %d-%d to %s", start, end, path)
+
+	// step 6: Send 204 No Content response
+	writeStatusLine(conn, http.StatusNoContent)
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n")
+}
+
+// parseContentRange parses "bytes start-end/total", returning total as -1 when it is "*"
+func parseContentRange(value string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("unit must be bytes")
+	}
+	rangePart, totalPart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("missing total length")
+	}
+	startPart, endPart, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("missing range")
+	}
+	if start, err = strconv.ParseInt(startPart, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid start %q", startPart)
+	}
+	if end, err = strconv.ParseInt(endPart, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid end %q", endPart)
+	}
+	total = -1
+	if totalPart != "*" {
+		if total, err = strconv.ParseInt(totalPart, 10, 64); err != nil || total <= end {
+			return 0, 0, 0, fmt.Errorf("invalid total %q", totalPart)
+		}
+	}
+	return start, end, total, nil
+}
+
+// etagFunc computes the ETag of a file from its stat result and path, "" for
+// none. It is a variable so a fixed value can stand in for it
+var etagFunc = defaultETag
+
+// defaultETag computes an ETag according to -etag
+func defaultETag(info os.FileInfo, path string) string {
+	switch *etagMode {
+	case "mtime":
+		return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+	case "content":
+		file, err := os.Open(path)
+		if err != nil {
+			return ""
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			errorf("Failed to hash %s for its ETag: %v", path, err)
+			return ""
+		}
+		return "\"" + hex.EncodeToString(hash.Sum(nil)) + "\""
+	}
+	return ""
+}
+
+// etagListMatches reports whether etag is in a comma separated If-Match or
+// If-None-Match list, or the list is "*". The weak comparison used for
+// If-None-Match ignores W/ prefixes, the strong one never matches weak tags
+func etagListMatches(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether a Content-Type is text that gzip shrinks well
+func compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || contentType == "application/json"
+}
+
+// gzipMajor and gzipMinor are the parsed -gzip-min-version
+var gzipMajor, gzipMinor int
+
+// gzipDeniedAgents are the lower-cased -gzip-deny-agents substrings
+var gzipDeniedAgents []string
+
+// compressionAllowed reports whether a client may be sent a compressed
+// response at all: old HTTP versions and known-bad User-Agents may not
+func compressionAllowed(req *http.Request) bool {
+	if !req.ProtoAtLeast(gzipMajor, gzipMinor) {
+		return false
+	}
+	agent := strings.ToLower(req.UserAgent())
+	for _, denied := range gzipDeniedAgents {
+		if strings.Contains(agent, denied) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsEncoding reports whether Accept-Encoding allows a content coding,
+// i.e. lists it or * without q=0, for a client compressionAllowed lets have it
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	if !compressionAllowed(req) {
+		return false
+	}
+	for _, coding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if name != encoding && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// addVary adds a header name to the Vary list, once
+func addVary(header http.Header, name string) {
+	vary := header.Get("Vary")
+	for _, listed := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(listed), name) {
+			return
+		}
+	}
+	if vary != "" {
+		header.Set("Vary", vary+", "+name)
+	} else {
+		header.Set("Vary", name)
+	}
+}
+
+// openSidecar opens the precompressed path.br or path.gz for a client that
+// accepts its encoding and asked for the whole file, preferring brotli
+func openSidecar(req *http.Request, root, path string) (*os.File, os.FileInfo, string) {
+	if req.Header.Get("Range") != "" {
+		return nil, nil, ""
+	}
+	for _, sidecar := range []struct{ ext, encoding string }{{".br", "br"}, {".gz", "gzip"}} {
+		if !acceptsEncoding(req, sidecar.encoding) || !insideRoot(root, path+sidecar.ext) {
+			continue
+		}
+		file, err := os.Open(path + sidecar.ext)
+		if err != nil {
+			continue
+		}
+		if stat, err := file.Stat(); err == nil && stat.Mode().IsRegular() {
+			return file, stat, sidecar.encoding
+		}
+		file.Close()
+	}
+	return nil, nil, ""
+}
+
+// sendCompressed sends the content of the file at path gzip compressed. Its
+// compressed length is not known up front, so it goes through a responseWriter.
+// A HEAD is compressed too, so that its headers match the GET's exactly
+func sendCompressed(conn net.Conn, req *http.Request, content io.Reader, path, contentType string, header http.Header, etag string) {
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Encoding", "gzip")
+	if etag != "" {
+		header["ETag"] = []string{etag} // http.Header would canonicalize the name to "Etag"
+	}
+	w := newResponseWriter(conn, req, http.StatusOK, header)
+	gz := gzip.NewWriter(w)
+	_, err := io.Copy(gz, content)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		warnf("Failed to send compressed %s: %v", path, err)
+		w.Abort()
+	}
+}
+
+// notModified reports whether If-None-Match or, without it, If-Modified-Since
+// shows the client already has the current version. HTTP dates have
+// whole-second precision
+func notModified(req *http.Request, modTime time.Time, etag string) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagListMatches(ifNoneMatch, etag, true)
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// sendNotModified is a helper function to send 304 with the validators and
+// caching headers a 200 would have carried, and no body
+func sendNotModified(conn net.Conn, header http.Header, etag string) {
+	debugf("Sending 304 Not Modified")
+	writeStatusLine(conn, http.StatusNotModified)
+	// http.Header would canonicalize the name to "Etag"
+	if etag != "" {
+		fmt.Fprintf(conn, "ETag: %s\r\n", etag)
+	}
+	for _, name := range []string{"Last-Modified", "Vary", "Content-Language", "Cache-Control"} {
+		if value := header.Get(name); value != "" {
+			fmt.Fprintf(conn, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+}
+
+// errUnsatisfiableRange reports a Range that lies entirely past the end of the file
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// parseRange parses a single "bytes=start-end", "bytes=start-" or "bytes=-suffix"
+// Range header against a file of size bytes, returning the start and length to send
+func parseRange(value string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes=")
+	if !ok {
+		return 0, 0, fmt.Errorf("unit must be bytes")
+	}
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("multiple ranges are not supported")
+	}
+	startPart, endPart, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("missing range")
+	}
+
+	// "-n" asks for the last n bytes
+	if startPart == "" {
+		suffix, err := strconv.ParseInt(endPart, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, fmt.Errorf("invalid suffix length %q", endPart)
+		}
+		suffix = min(suffix, size)
+		if suffix == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.ParseInt(startPart, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid start %q", startPart)
+	}
+	end := size - 1
+	if endPart != "" {
+		if end, err = strconv.ParseInt(endPart, 10, 64); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid end %q", endPart)
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+	return start, end - start + 1, nil
+}
+
+// sendRangeNotSatisfiable is a helper function to send 416 with the file's actual size
+func sendRangeNotSatisfiable(conn net.Conn, size int64) {
+	body := fmt.Sprintf("%d %s", http.StatusRequestedRangeNotSatisfiable, http.StatusText(http.StatusRequestedRangeNotSatisfiable))
+	writeStatusLine(conn, http.StatusRequestedRangeNotSatisfiable)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Content-Range: bytes */%d\r\n", size)
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// sniffTextSize is how many bytes sniffTextType peeks at
+const sniffTextSize = 512
+
+// loadMimeTypes adds the entries of an Apache-style mime.types file, lines of
+// "type/subtype ext ext..." with # comments, to mimeTypes
+func loadMimeTypes(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.Contains(fields[0], "/") {
+			return fmt.Errorf("%s:%d: %q is not a media type", path, line, fields[0])
+		}
+		for _, ext := range fields[1:] {
+			mimeTypes["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	return scanner.Err()
+}
+
+// fileContentType picks the Content-Type of a file from its extension, or from
+// its first bytes when the extension is unknown
+func fileContentType(file *os.File, path string) string {
+	contentType, ok := mimeTypes[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		contentType = detectContentType(file)
+	}
+	// Plain text files may really be JSON or CSV
+	if *sniffText && contentType == "text/plain" {
+		contentType = sniffTextType(file, contentType)
+	}
+	return contentType
+}
+
+// detectContentType is a helper function to guess the type of a file with an
+// unknown extension from its first bytes, rewinding it afterwards
+func detectContentType(file *os.File) string {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		errorf("Failed to rewind %s after sniffing: %v", file.Name(), seekErr)
+		return defaultMimeType
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return defaultMimeType
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// sniffTextType peeks at the start of a text file to tell JSON and CSV apart
+// from plain text, then rewinds the file
+func sniffTextType(file *os.File, fallback string) string {
+	buf := make([]byte, sniffTextSize)
+	n, err := io.ReadFull(file, buf)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		errorf("Failed to rewind %s after sniffing: %v", file.Name(), seekErr)
+		return fallback
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fallback
+	}
+	head := strings.TrimLeft(strings.TrimPrefix(string(buf[:n]), "\ufeff"), " \t\r\n")
+
+	// JSON documents start with an object or an array
+	if strings.HasPrefix(head, "{") || strings.HasPrefix(head, "[") {
+		return "application/json"
+	}
+
+	// CSV: the complete lines we saw all have the same, non-zero number of commas
+	lines := strings.Split(head, "\n")
+	if n == sniffTextSize && len(lines) > 1 {
+		lines = lines[:len(lines)-1] // last line may be cut off
+	}
+	commas := strings.Count(lines[0], ",")
+	if commas == 0 || len(lines) < 2 {
+		return fallback
+	}
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line != "" && strings.Count(line, ",") != commas {
+			return fallback
+		}
+	}
+	return "text/csv"
+}
+
+// maxSuggestions caps the number of did-you-mean links on a 404 page
+const maxSuggestions = 5
+
+// sendNotFoundWithSuggestions sends an HTML 404 listing files in the same
+// directory whose names are within a small edit distance of the requested one
+func sendNotFoundWithSuggestions(conn net.Conn, req *http.Request, path string) {
+	suggestions := similarNames(filepath.Dir(path), filepath.Base(path))
+	if len(suggestions) == 0 {
+		sendErrorResponse(conn, http.StatusNotFound, "")
+		return
+	}
+
+	urlDir := req.URL.Path[:strings.LastIndex(req.URL.Path, "/")+1]
+	var b strings.Builder
+	b.WriteString("<html><body><h1>404 Not Found</h1><p>Did you mean:</p><ul>")
+	for _, name := range suggestions {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>", html.EscapeString(urlDir+url.PathEscape(name)), html.EscapeString(name))
+	}
+	b.WriteString("</ul></body></html>")
+	body := b.String()
+	debugf("Sending error: 404 Not Found with %d suggestions", len(suggestions))
+
+	writeStatusLine(conn, http.StatusNotFound)
+	fmt.Fprintf(conn, "Content-Type: text/html\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// similarNames returns up to maxSuggestions names in dir closest to name,
+// skipping directories larger than -suggest-max-entries
+func similarNames(dir, name string) []string {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	entries, err := d.ReadDir(*suggestMaxDir + 1)
+	if (err != nil && err != io.EOF) || len(entries) > *suggestMaxDir {
+		return nil
+	}
+
+	// Allow roughly one typo per four characters, at least one
+	limit := max(1, len(name)/4)
+	type candidate struct {
+		name     string
+		distance int
+	}
+	var candidates []candidate
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if d := editDistance(strings.ToLower(name), strings.ToLower(entry.Name())); d <= limit {
+			candidates = append(candidates, candidate{entry.Name(), d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	var names []string
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		names = append(names, candidates[i].name)
+	}
+	return names
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// serveArchive streams dir as a tar.gz through a responseWriter
+func serveArchive(conn net.Conn, req *http.Request, dir string) {
+	name := filepath.Base(dir)
+	if dir == "." {
+		name = filepath.Base(rootDir)
+	}
+	debugf("Archiving directory %s", dir)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/gzip")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tar.gz\"", strings.ReplaceAll(name, "\"", "")))
+	w := newResponseWriter(conn, req, http.StatusOK, header)
+	if req.Method == "HEAD" {
+		// Not worth archiving the directory for: the headers are those of a streamed GET
+		w.start()
+		w.Close()
+		return
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			warnf("Skipping %s in archive: %v", path, err)
+			return nil
+		}
+		// Symlinks could point outside the served directory
+		if d.Type()&os.ModeSymlink != 0 {
+			warnf("Skipping symlink %s in archive", path)
+			return nil
+		}
+		if path == dir || (!d.IsDir() && !d.Type().IsRegular()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		return addToArchive(tw, path, filepath.ToSlash(rel), d)
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		warnf("Failed to send archive of %s: %v", dir, err)
+		w.Abort()
+	}
+}
+
+// addToArchive is a helper function to write one file or directory entry,
+// skipping files that cannot be read. Only write errors are returned
+func addToArchive(tw *tar.Writer, path, name string, d os.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		warnf("Skipping %s in archive: %v", path, err)
+		return nil
+	}
+	if d.IsDir() {
+		header, _ := tar.FileInfoHeader(info, "")
+		header.Name = name + "/"
+		return tw.WriteHeader(header)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		warnf("Skipping %s in archive: %v", path, err)
+		return nil
+	}
+	defer file.Close()
+
+	header, _ := tar.FileInfoHeader(info, "")
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// A file that shrinks while being read is padded so the archive stays valid
+	n, err := io.Copy(tw, io.LimitReader(file, info.Size()))
+	if err != nil {
+		errorf("Failed to read %s for archive: %v", path, err)
+	}
+	if n < info.Size() {
+		if _, err := io.CopyN(tw, zeroReader{}, info.Size()-n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroReader is an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Bodies up to these sizes are buffered so they can be sent with a
+// Content-Length. HTTP/1.0 clients do not understand chunked encoding, so
+// they get a much larger buffer before falling back to closing the connection
+const (
+	maxBufferedBody       = 32 << 10
+	maxBufferedBodyHTTP10 = 8 << 20
+)
+
+// responseWriter sends a response whose length is not known up front.
+// Small bodies are sent with a Content-Length; larger ones are chunked for
+// HTTP/1.1 clients, and for HTTP/1.0 clients sent without a length and
+// ended by closing the connection
+type responseWriter struct {
+	conn    net.Conn
+	status  int
+	header  http.Header
+	chunked bool // streaming in chunks once started, else until close
+	head    bool // HEAD request: framed like the GET, but the body is dropped
+	limit   int
+
+	buf     bytes.Buffer  // body collected before the headers are sent
+	out     *bufio.Writer // body stream once the headers are sent
+	chunks  *chunkedWriter
+	started bool
+}
+
+// newResponseWriter prepares a response with the given status and headers;
+// nothing is sent until the body outgrows the buffer or Close is called
+func newResponseWriter(conn net.Conn, req *http.Request, status int, header http.Header) *responseWriter {
+	w := &responseWriter{conn: conn, status: status, header: header, chunked: req.ProtoAtLeast(1, 1), head: req.Method == "HEAD", limit: maxBufferedBody}
+	if !w.chunked {
+		w.limit = maxBufferedBodyHTTP10
+	}
+	return w
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.started {
+		return w.out.Write(p)
+	}
+	w.buf.Write(p)
+	if w.buf.Len() > w.limit {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers without a length and begins streaming the body
+func (w *responseWriter) start() error {
+	w.started = true
+	headers := getHeaderWriter(w.conn)
+	defer putHeaderWriter(headers)
+	writeStatusLine(headers, w.status)
+	w.header.Write(headers)
+	if w.chunked {
+		fmt.Fprintf(headers, "Transfer-Encoding: chunked\r\n")
+	} else {
+		closeAfterResponse(w.conn)
+	}
+	fmt.Fprintf(headers, "Connection: %s\r\n", connectionHeader(w.conn))
+	fmt.Fprintf(headers, "\r\n") // End of headers
+	if err := headers.Flush(); err != nil {
+		return err
+	}
+
+	var body io.Writer = w.conn
+	switch {
+	case w.head:
+		body = io.Discard
+	case w.chunked:
+		w.chunks = &chunkedWriter{w: w.conn}
+		body = w.chunks
+	}
+	w.out = bufio.NewWriterSize(body, maxBufferedBody)
+	_, err := w.out.Write(w.buf.Bytes())
+	w.buf = bytes.Buffer{}
+	return err
+}
+
+// Close finishes the response: a buffered body is sent with its length, a
+// streamed one is flushed and, when chunked, terminated
+func (w *responseWriter) Close() error {
+	if !w.started {
+		w.started = true
+		headers := getHeaderWriter(w.conn)
+		defer putHeaderWriter(headers)
+		writeStatusLine(headers, w.status)
+		w.header.Write(headers)
+		fmt.Fprintf(headers, "Content-Length: %d\r\n", w.buf.Len())
+		fmt.Fprintf(headers, "Connection: %s\r\n", connectionHeader(w.conn))
+		fmt.Fprintf(headers, "\r\n") // End of headers
+		if !w.head {
+			headers.Write(w.buf.Bytes())
+		}
+		return headers.Flush()
+	}
+	if err := w.out.Flush(); err != nil {
+		return err
+	}
+	if w.chunks != nil {
+		return w.chunks.Close()
+	}
+	return nil
+}
+
+// Abort gives up on the response after an error: a 500 if nothing was sent
+// yet, otherwise the connection is closed so the client sees the body end early
+func (w *responseWriter) Abort() {
+	if !w.started {
+		w.started = true
+		sendErrorResponse(w.conn, http.StatusInternalServerError, "")
+		return
+	}
+	closeAfterResponse(w.conn)
+}
+
+// chunkedWriter frames each write as one HTTP/1.1 chunk
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil // a zero-length chunk would end the body
+	}
+	if _, err := fmt.Fprintf(c.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	if err == nil {
+		_, err = io.WriteString(c.w, "\r\n")
+	}
+	return n, err
+}
+
+// Close writes the last chunk and the empty trailer
+func (c *chunkedWriter) Close() error {
+	_, err := io.WriteString(c.w, "0\r\n\r\n")
+	return err
+}
+
+// sendRedirect is a helper function to send redirect responses
+func sendRedirect(conn net.Conn, code int, location string) {
+	body := fmt.Sprintf("%d %s: %s", code, http.StatusText(code), location)
+	debugf("Redirecting to %s (%d)", location, code)
+
+	writeStatusLine(conn, code)
+	fmt.Fprintf(conn, "Location: %s\r\n", location)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// securityHeader returns the -security-headers for a response, nil when they
+// are off. HSTS only means something over HTTPS
+func securityHeader(overTLS bool) http.Header {
+	if !*securityHeaders {
+		return nil
+	}
+	header := make(http.Header)
+	header.Set("X-Content-Type-Options", "nosniff")
+	if *frameOptions != "" {
+		header.Set("X-Frame-Options", *frameOptions)
+	}
+	if *referrerPolicy != "" {
+		header.Set("Referrer-Policy", *referrerPolicy)
+	}
+	if *cspPolicy != "" {
+		header.Set("Content-Security-Policy", *cspPolicy)
+	}
+	if overTLS && *hstsMaxAge > 0 {
+		header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(hstsMaxAge.Seconds())))
+	}
+	return header
+}
+
+// headerWriters recycles the writers that response headers are assembled in
+var headerWriters = sync.Pool{New: func() any { return bufio.NewWriter(nil) }}
+
+// copyBuffers recycles the buffers of body copies that cannot use sendfile
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 32*1024)
+	return &buf
+}}
+
+// getHeaderWriter returns a pooled buffered writer for w
+func getHeaderWriter(w io.Writer) *bufio.Writer {
+	headers := headerWriters.Get().(*bufio.Writer)
+	headers.Reset(w)
+	return headers
+}
+
+// putHeaderWriter returns a writer to the pool, dropping its destination
+func putHeaderWriter(headers *bufio.Writer) {
+	headers.Reset(nil)
+	headerWriters.Put(headers)
+}
+
+// writeStatusLine writes the status line; the reason phrase always comes from
+// http.StatusText, descriptive text belongs in the body
+func writeStatusLine(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+}
+
+// sendErrorResponse is a helper function to send error responses, with an
+// optional detail message appended to the body
+func sendErrorResponse(conn net.Conn, code int, detail string) {
+	body := fmt.Sprintf("%d %s", code, http.StatusText(code))
+	if detail != "" {
+		body += ": " + detail
+	}
+	debugf("Sending error: %s", body)
+
+	contentType := "text/plain"
+	if page, found := errorPages[code]; found {
+		if data, err := os.ReadFile(page); err == nil {
+			body = string(data)
+			if contentType = mimeTypes[strings.ToLower(filepath.Ext(page))]; contentType == "" {
+				contentType = "text/html"
+			}
+		} else {
+			warnf("Error page for %d unavailable, sending plain text: %v", code, err)
+		}
+	}
+
+	writeStatusLine(conn, code)
+	fmt.Fprintf(conn, "Content-Type: %s\r\n", contentType)
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// sendClosingError sends an error response and closes the connection after
+// it. Errors that leave the request's framing in doubt, such as malformed
+// input or a body abandoned part way, use it; the others keep the connection
+func sendClosingError(conn net.Conn, code int, detail string) {
+	closeAfterResponse(conn)
+	sendErrorResponse(conn, code, detail)
+}
+
+// errorPages maps status codes in -error-pages to absolute paths of the pages
+// sent in place of the plain-text error body
+var errorPages = make(map[int]string)
+
+// parseErrorPages parses -error-pages "code=file,code=file", making each file
+// absolute so that -root does not move it
+func parseErrorPages(value string) (map[int]string, error) {
+	pages := make(map[int]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		codeText, file, ok := strings.Cut(entry, "=")
+		code, err := strconv.Atoi(strings.TrimSpace(codeText))
+		if !ok || err != nil || code < 400 || code > 599 || strings.TrimSpace(file) == "" {
+			return nil, fmt.Errorf("%q is not code=file with a 4xx or 5xx code", entry)
+		}
+		abs, err := filepath.Abs(strings.TrimSpace(file))
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(abs); err != nil || info.IsDir() {
+			return nil, fmt.Errorf("page for %d is not a file: %s", code, abs)
+		}
+		pages[code] = abs
+	}
+	return pages, nil
+}
+
+// countingConn wraps a connection and counts the bytes read from and written to it.
+// It also notes the status code of the response being written.
+type countingConn struct {
+	net.Conn
+	read      int64
+	written   int64
+	status    int  // status of the current response, 0 until its status line is written
+	keepAlive bool // the connection stays open for another request after this response
+
+	// Where the current response's headers end: the body is counted for the
+	// access log, and discarded for HEAD requests
+	headOnly    bool
+	inBody      bool
+	bodyWritten int64
+	tail        []byte // last bytes written, to find the end of the headers across writes
+
+	// extraHeader is added to the current response, whichever handler writes it
+	extraHeader http.Header
+
+	// user is the -htpasswd user the current request authenticated as, for the access log
+	user string
+
+	// reader is the buffered reader requests are parsed from, nil for HTTP/2
+	reader *bufio.Reader
+}
+
+// ReadFrom lets io.Copy of a file into the body of a response use sendfile(2)
+// when the connection is plain TCP, and a pooled buffer otherwise
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	if readerFrom, ok := c.Conn.(io.ReaderFrom); ok && c.inBody && !c.headOnly {
+		n, err := readerFrom.ReadFrom(r)
+		c.written += n
+		c.bodyWritten += n
+		return n, err
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{c}, r, *buf)
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	if c.status == 0 && bytes.HasPrefix(p, []byte("HTTP/1.1 ")) && len(p) >= 12 {
+		c.status, _ = strconv.Atoi(string(p[9:12]))
+
+		// The extra headers go right after the status line
+		if end := bytes.Index(p, []byte("\r\n")); end >= 0 && len(c.extraHeader) > 0 {
+			var buf bytes.Buffer
+			buf.Write(p[:end+2])
+			c.extraHeader.Write(&buf)
+			buf.Write(p[end+2:])
+			if _, err := c.write(buf.Bytes()); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+	}
+	return c.write(p)
+}
+
+// write sends p, counting the header and body bytes of the current response
+func (c *countingConn) write(p []byte) (int, error) {
+	if c.inBody {
+		if c.headOnly {
+			return len(p), nil
+		}
+		n, err := c.Conn.Write(p)
+		c.written += int64(n)
+		c.bodyWritten += int64(n)
+		return n, err
+	}
+
+	end := c.headerEnd(p)
+	if end < 0 {
+		n, err := c.Conn.Write(p)
+		c.written += int64(n)
+		return n, err
+	}
+	// The headers end inside p, the rest is body
+	c.inBody = true
+	n, err := c.Conn.Write(p[:end])
+	c.written += int64(n)
+	if err != nil || end == len(p) {
+		return n, err
+	}
+	if c.headOnly {
+		return len(p), nil
+	}
+	m, err := c.Conn.Write(p[end:])
+	c.written += int64(m)
+	c.bodyWritten += int64(m)
+	return n + m, err
+}
+
+// headerEnd returns the length of p up to and including the blank line
+// ending the headers, or -1 if the headers do not end in p
+func (c *countingConn) headerEnd(p []byte) int {
+	blankLine := []byte("\r\n\r\n")
+	if len(c.tail) > 0 {
+		joined := append(c.tail, p[:min(len(p), 3)]...)
+		if i := bytes.Index(joined, blankLine); i >= 0 {
+			return i + 4 - len(c.tail)
+		}
+	}
+	if i := bytes.Index(p, blankLine); i >= 0 {
+		return i + 4
+	}
+	joined := append(c.tail, p[max(0, len(p)-3):]...)
+	c.tail = append(c.tail[:0], joined[max(0, len(joined)-3):]...)
+	return -1
+}
+
+// startResponse resets the per-response state before a response is written,
+// headOnly for the answer to a HEAD request
+func (c *countingConn) startResponse(headOnly bool) {
+	c.status = 0
+	c.headOnly = headOnly
+	c.inBody = false
+	c.bodyWritten = 0
+	c.tail = c.tail[:0]
+	c.extraHeader = nil
+	c.user = ""
+}
+
+// hostOnly strips the port from a "host:port" address
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// maxProxyHeaderLen is the longest PROXY protocol v1 line allowed by the spec
+const maxProxyHeaderLen = 107
+
+// readProxyHeader consumes a PROXY protocol v1 header line and returns the
+// client address it carries, or "" for "PROXY UNKNOWN"
+func readProxyHeader(reader *bufio.Reader) (string, error) {
+	// step 1: Read the header line without going past the spec's limit
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxProxyHeaderLen {
+			return "", fmt.Errorf("header longer than %d bytes", maxProxyHeaderLen)
+		}
+	}
+	if !strings.HasSuffix(string(line), "\r\n") {
+		return "", fmt.Errorf("header not terminated by CRLF")
+	}
+
+	// step 2: Split "PROXY <proto> <src> <dst> <sport> <dport>"
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return "", fmt.Errorf("missing PROXY signature")
+	}
+	if fields[1] == "UNKNOWN" {
+		return "", nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return "", fmt.Errorf("malformed header %q", strings.TrimSpace(string(line)))
+	}
+
+	// step 3: Validate the source address and port
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return "", fmt.Errorf("invalid source address %q", fields[2])
+	}
+	if p, err := strconv.Atoi(fields[4]); err != nil || p < 0 || p > 65535 {
+		return "", fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return net.JoinHostPort(fields[2], fields[4]), nil
+}
+
+// bandwidthQuota tracks the bytes served to each client IP over a sliding window
+type bandwidthQuota struct {
+	mu      sync.Mutex
+	limit   int64
+	window  time.Duration
+	clients map[string]*ipUsage
+}
+
+// ipUsage holds the recent usage samples of one client IP, oldest first
+type ipUsage struct {
+	samples  []usageSample
+	total    int64
+	lastSeen time.Time
+}
+
+type usageSample struct {
+	at    time.Time
+	bytes int64
+}
+
+func newBandwidthQuota(limit int64, window time.Duration) *bandwidthQuota {
+	return &bandwidthQuota{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*ipUsage),
+	}
+}
+
+// add charges n bytes to ip
+func (q *bandwidthQuota) add(ip string, n int64) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage, ok := q.clients[ip]
+	if !ok {
+		usage = &ipUsage{}
+		q.clients[ip] = usage
+	}
+	// Merge samples within the same second to keep the list short
+	if last := len(usage.samples) - 1; last >= 0 && now.Sub(usage.samples[last].at) < time.Second {
+		usage.samples[last].bytes += n
+	} else {
+		usage.samples = append(usage.samples, usageSample{at: now, bytes: n})
+	}
+	usage.total += n
+	usage.lastSeen = now
+}
+
+// exceeded reports whether ip has been served at least the quota within the window
+func (q *bandwidthQuota) exceeded(ip string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage, ok := q.clients[ip]
+	if !ok {
+		return false
+	}
+	usage.prune(time.Now().Add(-q.window))
+	return usage.total >= q.limit
+}
+
+// prune drops the samples older than cutoff
+func (u *ipUsage) prune(cutoff time.Time) {
+	i := 0
+	for i < len(u.samples) && u.samples[i].at.Before(cutoff) {
+		u.total -= u.samples[i].bytes
+		i++
+	}
+	u.samples = u.samples[i:]
+}
+
+// cleanupLoop periodically forgets IPs that have been idle for a whole window
+func (q *bandwidthQuota) cleanupLoop() {
+	ticker := time.NewTicker(q.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-q.window)
+		q.mu.Lock()
+		for ip, usage := range q.clients {
+			if usage.lastSeen.Before(cutoff) {
+				delete(q.clients, ip)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// rateLimiter is a token bucket per client IP: each bucket holds up to burst
+// tokens, refills at rate tokens per second, and every request takes one
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for ip, or reports how long until the next one is available
+func (l *rateLimiter) allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.clients[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[ip] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// cleanupLoop periodically forgets IPs whose buckets have refilled completely,
+// as a new bucket would be the same
+func (l *rateLimiter) cleanupLoop() {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	ticker := time.NewTicker(max(refill, time.Minute))
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-refill)
+		l.mu.Lock()
+		for ip, bucket := range l.clients {
+			if bucket.last.Before(cutoff) {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// sendTooManyRequests is a helper function to send 429 with the whole seconds
+// until the client may try again
+func sendTooManyRequests(conn net.Conn, wait time.Duration) {
+	body := fmt.Sprintf("%d %s", http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+	writeStatusLine(conn, http.StatusTooManyRequests)
+	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Retry-After: %d\r\n", int64(max(time.Second, wait+time.Second-1)/time.Second))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// contentCache is an LRU cache of file contents, bounded by their total size
+type contentCache struct {
+	mu      sync.Mutex
+	limit   int64
+	size    int64
+	entries map[string]*list.Element // of *cachedFile, most recently used at the front
+	order   *list.List
+	hits    int64
+	misses  int64
+}
+
+// cachedFile is a file's content with what it is served with. It is only
+// valid while the file keeps its size and modification time
+type cachedFile struct {
+	path        string
+	size        int64
+	modTime     time.Time
+	contentType string
+	etag        string
+	body        []byte
+}
+
+func newContentCache(limit int64) *contentCache {
+	return &contentCache{
+		limit:   limit,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached copy of path if it matches stat, dropping a stale one
+func (c *contentCache) get(path string, stat os.FileInfo) *cachedFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[path]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	entry := element.Value.(*cachedFile)
+	if entry.size != stat.Size() || !entry.modTime.Equal(stat.ModTime()) {
+		c.remove(element)
+		c.misses++
+		return nil
+	}
+	c.order.MoveToFront(element)
+	c.hits++
+	return entry
+}
+
+// add reads file and caches it, evicting the least recently used entries to
+// make room. It returns nil, leaving file where it was, if the read fails
+func (c *contentCache) add(path string, stat os.FileInfo, file *os.File, contentType, etag string) *cachedFile {
+	body := make([]byte, stat.Size())
+	if _, err := io.ReadFull(file, body); err != nil {
+		warnf("Failed to cache %s: %v", path, err)
+		file.Seek(0, io.SeekStart)
+		return nil
+	}
+	entry := &cachedFile{path: path, size: stat.Size(), modTime: stat.ModTime(), contentType: contentType, etag: etag, body: body}
+	if entry.size > c.limit {
+		return entry
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+	for c.size+entry.size > c.limit {
+		c.remove(c.order.Back())
+	}
+	c.entries[path] = c.order.PushFront(entry)
+	c.size += entry.size
+	return entry
+}
+
+// remove drops an entry; the caller holds c.mu
+func (c *contentCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cachedFile)
+	delete(c.entries, entry.path)
+	c.size -= entry.size
+}
+
+// preloadCache reads the files matching the -preload globs into the cache, so
+// their first requests after a restart do not go to disk
+func preloadCache(patterns string) {
+	files, total := 0, int64(0)
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			fatalf("Invalid -preload pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			warnf("-preload pattern %q matches no files", pattern)
+		}
+		for _, path := range matches {
+			if entry := preloadFile(path); entry != nil {
+				debugf("Preloaded %s (%d bytes)", path, entry.size)
+				files++
+				total += entry.size
+			}
+		}
+	}
+	infof("Preloaded %d file(s), %d bytes, into the cache", files, total)
+}
+
+// preloadFile caches one file the way handleGet would, or returns nil when it
+// cannot or should not be cached
+func preloadFile(path string) *cachedFile {
+	file, err := os.Open(path)
+	if err != nil {
+		warnf("Failed to preload %s: %v", path, err)
+		return nil
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		return nil
+	}
+	if stat.Size() > *cacheMaxFile {
+		warnf("Not preloading %s: %d bytes is over -cache-max-file", path, stat.Size())
+		return nil
+	}
+	contentType := fileContentType(file, path)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	return fileCache.add(path, stat, file, contentType, etagFunc(stat, path))
+}
+
+// counters returns the hits, misses and cached bytes so far
+func (c *contentCache) counters() (hits, misses, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.size
+}
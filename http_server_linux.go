@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// shutdownSignals make the server stop accepting and finish the requests in flight
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// soReusePort returns SO_REUSEPORT for the architecture. The syscall package
+// does not export it everywhere, and the MIPS and SPARC ports use their own value
+func soReusePort() int {
+	switch runtime.GOARCH {
+	case "mips", "mipsle", "mips64", "mips64le", "sparc64":
+		return 0x200
+	}
+	return 0xf
+}
+
+// setReusePort sets SO_REUSEPORT on the listening socket
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort(), 1)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("setting SO_REUSEPORT: %w", sockErr)
+	}
+	return nil
+}
+
+// freeDiskSpace returns the bytes available to the server on the file system holding dir
+func freeDiskSpace(dir string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), nil
+}
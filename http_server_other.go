@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// shutdownSignals make the server stop accepting and finish the requests in flight
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// setReusePort refuses -reuseport, which is only implemented on Linux
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("-reuseport is not supported on %s", runtime.GOOS)
+}
+
+// freeDiskSpace is not implemented here, so the health check reports the disk as "unknown"
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,1106 @@
+package main
+
+// The server is built from a list of files, so the tests are run the same way:
+//
+//	go test http_server.go http_server_linux.go http_server_test.go
+//	go test -run '^$' -bench . http_server.go http_server_linux.go http_server_test.go
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordConn is a net.Conn that keeps what a handler writes
+type recordConn struct {
+	out bytes.Buffer
+}
+
+func (c *recordConn) Read(p []byte) (int, error)         { return 0, io.EOF }
+func (c *recordConn) Write(p []byte) (int, error)        { return c.out.Write(p) }
+func (c *recordConn) Close() error                       { return nil }
+func (c *recordConn) LocalAddr() net.Addr                { return stringAddr("127.0.0.1:8080") }
+func (c *recordConn) RemoteAddr() net.Addr               { return stringAddr("127.0.0.1:50000") }
+func (c *recordConn) SetDeadline(t time.Time) error      { return nil }
+func (c *recordConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *recordConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// enterRoot serves files from a new temporary directory holding files for the
+// rest of the test
+func enterRoot(tb testing.TB, files map[string]string) {
+	tb.Helper()
+	dir := tb.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(dir+"/"+name, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	previous, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		tb.Fatal(err)
+	}
+	rootDir = dir
+	rootAvailable.Store(true)
+	tb.Cleanup(func() { os.Chdir(previous) })
+}
+
+// serve runs a raw request through handleRequest and returns the raw response
+func serve(tb testing.TB, raw string) []byte {
+	tb.Helper()
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn := &recordConn{}
+	handleRequest(&countingConn{Conn: conn}, req, "127.0.0.1:50000", "127.0.0.1")
+	return conn.out.Bytes()
+}
+
+// benchmarkGet measures serving one small file over and over
+func benchmarkGet(b *testing.B) {
+	enterRoot(b, map[string]string{"page.html": strings.Repeat("<p>hello</p>\n", 300)})
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET /page.html HTTP/1.1\r\nHost: localhost\r\n\r\n")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := &recordConn{}
+	counter := &countingConn{Conn: conn}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.out.Reset()
+		handleRequest(counter, req, "127.0.0.1:50000", "127.0.0.1")
+	}
+	b.StopTimer()
+	if !bytes.HasPrefix(conn.out.Bytes(), []byte("HTTP/1.1 200 ")) {
+		b.Fatalf("unexpected response:\n%s", conn.out.Bytes())
+	}
+}
+
+func BenchmarkGetUncached(b *testing.B) {
+	benchmarkGet(b)
+}
+
+func BenchmarkGetCached(b *testing.B) {
+	fileCache = newContentCache(1 << 20)
+	defer func() { fileCache = nil }()
+	benchmarkGet(b)
+}
+
+func TestSPAHeadServesIndexHeaders(t *testing.T) {
+	const index = "<html><body>app</body></html>\n"
+	enterRoot(t, map[string]string{"index.html": index})
+	*spaFallback = true
+	defer func() { *spaFallback = false }()
+
+	get := serve(t, "GET /settings/profile HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	head := serve(t, "HEAD /settings/profile HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	getHeader, getBody, _ := bytes.Cut(get, []byte("\r\n\r\n"))
+	headHeader, headBody, found := bytes.Cut(head, []byte("\r\n\r\n"))
+	if !found {
+		t.Fatalf("HEAD response has no end of headers:\n%s", head)
+	}
+	if string(getBody) != index {
+		t.Fatalf("GET body = %q, want index.html", getBody)
+	}
+	if len(headBody) != 0 {
+		t.Errorf("HEAD response has a body: %q", headBody)
+	}
+	if !bytes.Equal(headHeader, getHeader) {
+		t.Errorf("HEAD headers differ from GET:\n%s\n\nGET:\n%s", headHeader, getHeader)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if resp.ContentLength != int64(len(index)) {
+		t.Errorf("Content-Length = %d, want %d", resp.ContentLength, len(index))
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", got)
+	}
+}
+
+func TestRejectedProxyHeaderReleasesSlot(t *testing.T) {
+	enterRoot(t, map[string]string{"index.html": "home\n"})
+	*proxyProtocol = true
+	defer func() { *proxyProtocol = false }()
+	const slots = 2
+	sem := make(chan struct{}, slots)
+	connectionLimit.Store(slots)
+	defer connectionLimit.Store(0)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The accept loop of main without -accept-queue: wait for a slot, then serve
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !acquireSlot(sem) {
+				conn.Close()
+				continue
+			}
+			go handleConnection(conn, sem)
+		}
+	}()
+
+	dial := func(payload string) []byte {
+		t.Helper()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, payload); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("no reply, is the slot still held? %v", err)
+		}
+		return reply
+	}
+	for i := 0; i < slots; i++ {
+		if reply := dial("GARBAGE\r\n"); len(reply) != 0 {
+			t.Fatalf("bad PROXY header answered with %q", reply)
+		}
+	}
+	reply := dial("PROXY TCP4 192.0.2.1 192.0.2.2 40000 80\r\nGET /index.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if !bytes.HasPrefix(reply, []byte("HTTP/1.1 200 ")) {
+		t.Fatalf("connection after %d rejected headers got:\n%s", slots, reply)
+	}
+}
+
+// response parses a raw response to a request with the given method
+func response(tb testing.TB, raw []byte, method string) *http.Response {
+	tb.Helper()
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), &http.Request{Method: method})
+	if err != nil {
+		tb.Fatalf("unparsable response: %v\n%s", err, raw)
+	}
+	return resp
+}
+
+func TestFixedETagConditionalGet(t *testing.T) {
+	enterRoot(t, map[string]string{"page.html": "<p>hello</p>\n"})
+	etagFunc = func(os.FileInfo, string) string { return `"fixed"` }
+	defer func() { etagFunc = defaultETag }()
+
+	resp := response(t, serve(t, "GET /page.html HTTP/1.1\r\nHost: localhost\r\n\r\n"), "GET")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"fixed"` {
+		t.Fatalf("got %d with ETag %q, want 200 with \"fixed\"", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{`"fixed"`, http.StatusNotModified},
+		{`W/"fixed"`, http.StatusNotModified},
+		{`"other", "fixed"`, http.StatusNotModified},
+		{`*`, http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		raw := serve(t, "GET /page.html HTTP/1.1\r\nHost: localhost\r\nIf-None-Match: "+tt.ifNoneMatch+"\r\n\r\n")
+		if got := response(t, raw, "GET").StatusCode; got != tt.want {
+			t.Errorf("If-None-Match: %s got %d, want %d", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
+
+func TestStrictHostMisdirected(t *testing.T) {
+	enterRoot(t, map[string]string{"page.html": "default\n"})
+	site := t.TempDir()
+	if err := os.WriteFile(site+"/page.html", []byte("site\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vhostRoots = map[string]string{"site.test": site}
+	*strictHost = true
+	defer func() {
+		vhostRoots = make(map[string]string)
+		*strictHost = false
+	}()
+
+	tests := []struct {
+		host       string
+		serverName string
+		want       int
+		body       string
+	}{
+		{"site.test", "", http.StatusOK, "site\n"},
+		{"SITE.test.:8080", "", http.StatusOK, "site\n"},
+		{"other.test", "", http.StatusMisdirectedRequest, ""},
+		{"site.test", "site.test", http.StatusOK, "site\n"},
+		{"site.test", "other.test", http.StatusMisdirectedRequest, ""},
+	}
+	for _, tt := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET /page.html HTTP/1.1\r\nHost: " + tt.host + "\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.serverName != "" {
+			req.TLS = &tls.ConnectionState{ServerName: tt.serverName}
+		}
+		conn := &recordConn{}
+		handleRequest(&countingConn{Conn: conn, keepAlive: true}, req, "127.0.0.1:50000", "127.0.0.1")
+		resp := response(t, conn.out.Bytes(), "GET")
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.want {
+			t.Errorf("Host %s, server name %q: got %d, want %d", tt.host, tt.serverName, resp.StatusCode, tt.want)
+			continue
+		}
+		if tt.want == http.StatusMisdirectedRequest && !resp.Close {
+			t.Errorf("Host %s, server name %q: 421 keeps the connection open", tt.host, tt.serverName)
+		}
+		if tt.want == http.StatusOK && string(body) != tt.body {
+			t.Errorf("Host %s: body %q, want %q", tt.host, body, tt.body)
+		}
+	}
+
+	*strictHost = false
+	resp := response(t, serve(t, "GET /page.html HTTP/1.1\r\nHost: other.test\r\n\r\n"), "GET")
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "default\n" {
+		t.Errorf("without -strict-host an unknown host got %d %q, want the default root", resp.StatusCode, body)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	enterRoot(t, nil)
+	corsRules = []corsRule{{prefix: "/api", origins: []string{"https://app.example"}}, {prefix: "/public", origins: []string{"*"}}}
+	*corsMaxAge = 90 * time.Second
+	defer func() {
+		corsRules = nil
+		*corsMaxAge = 10 * time.Minute
+		*corsHeaders = ""
+	}()
+	preflight := func(path, origin string) *http.Response {
+		t.Helper()
+		return response(t, serve(t, "OPTIONS "+path+" HTTP/1.1\r\nHost: localhost\r\nOrigin: "+origin+
+			"\r\nAccess-Control-Request-Method: PUT\r\nAccess-Control-Request-Headers: X-Token, Content-Type\r\n\r\n"), "OPTIONS")
+	}
+
+	resp := preflight("/api/items", "https://app.example")
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Headers": "X-Token, Content-Type",
+		"Access-Control-Max-Age":       "90",
+		"Vary":                         "Origin, Access-Control-Request-Headers",
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("preflight got %d, want 204", resp.StatusCode)
+	}
+	for name, value := range want {
+		if got := resp.Header.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	*corsHeaders = "Content-Type"
+	resp = preflight("/public/logo.png", "https://elsewhere.example")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+		t.Errorf("with -cors-headers Access-Control-Allow-Headers = %q, want Content-Type", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "" {
+		t.Errorf("Vary = %q for a fixed answer, want none", got)
+	}
+}
+
+func TestCORSPerPrefix(t *testing.T) {
+	enterRoot(t, map[string]string{"page.html": "page\n"})
+	for _, dir := range []string{"api", "api/admin", "apix", "public"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dir+"/page.html", []byte("page\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corsRules = []corsRule{
+		{prefix: "/api", origins: []string{"https://app.example", "https://admin.example"}},
+		{prefix: "/api/admin", origins: []string{"https://admin.example"}},
+		{prefix: "/public", origins: []string{"*"}},
+	}
+	defer func() { corsRules = nil }()
+
+	tests := []struct {
+		path, origin string
+		allow        string
+		varyOrigin   bool
+	}{
+		{"/api/page.html", "https://app.example", "https://app.example", true},
+		{"/api/admin/page.html", "https://admin.example", "https://admin.example", true},
+		{"/api/admin/page.html", "https://app.example", "", true},
+		{"/api/page.html", "", "", true},
+		{"/public/page.html", "https://elsewhere.example", "*", false},
+		{"/apix/page.html", "https://app.example", "", false},
+		{"/page.html", "https://app.example", "", false},
+		{"/public/../api/admin/page.html", "https://app.example", "", true},
+	}
+	for _, tt := range tests {
+		raw := "GET " + tt.path + " HTTP/1.1\r\nHost: localhost\r\n"
+		if tt.origin != "" {
+			raw += "Origin: " + tt.origin + "\r\n"
+		}
+		resp := response(t, serve(t, raw+"\r\n"), "GET")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s got %d, want 200", tt.path, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("GET %s from %q: Access-Control-Allow-Origin = %q, want %q", tt.path, tt.origin, got, tt.allow)
+		}
+		vary := strings.Join(resp.Header.Values("Vary"), ", ")
+		if strings.Contains(vary, "Origin") != tt.varyOrigin {
+			t.Errorf("GET %s from %q: Vary = %q, want Origin listed: %v", tt.path, tt.origin, vary, tt.varyOrigin)
+		}
+	}
+
+	// Without a rule a preflight is a plain OPTIONS request
+	resp := response(t, serve(t, "OPTIONS /page.html HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example\r\nAccess-Control-Request-Method: PUT\r\n\r\n"), "OPTIONS")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" || resp.Header.Get("Access-Control-Max-Age") != "" {
+		t.Errorf("preflight outside every prefix got CORS headers: %v", resp.Header)
+	}
+}
+
+func TestResponseWriterFraming(t *testing.T) {
+	tests := []struct {
+		proto   string
+		size    int
+		length  bool // sent with Content-Length
+		chunked bool
+	}{
+		{"HTTP/1.1", 100, true, false},
+		{"HTTP/1.1", maxBufferedBody + 1, false, true},
+		{"HTTP/1.0", maxBufferedBody + 1, true, false},
+		{"HTTP/1.0", maxBufferedBodyHTTP10 + 1, false, false},
+	}
+	for _, tt := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET /gen " + tt.proto + "\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &recordConn{}
+		counter := &countingConn{Conn: conn, keepAlive: true}
+		body := bytes.Repeat([]byte("x"), tt.size)
+		w := newResponseWriter(counter, req, http.StatusOK, http.Header{"Content-Type": {"text/plain"}})
+		w.Write(body)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		head, _, _ := bytes.Cut(conn.out.Bytes(), []byte("\r\n\r\n"))
+		hasLength := bytes.Contains(head, []byte("\r\nContent-Length: "))
+		hasChunked := bytes.Contains(head, []byte("\r\nTransfer-Encoding: chunked"))
+		if hasLength != tt.length || hasChunked != tt.chunked {
+			t.Errorf("%s with %d bytes: Content-Length %v, chunked %v; want %v, %v", tt.proto, tt.size, hasLength, hasChunked, tt.length, tt.chunked)
+		}
+		// Without either the end of the body is the end of the connection
+		if !tt.length && !tt.chunked && counter.keepAlive {
+			t.Errorf("%s with %d bytes: unframed body on a connection kept alive", tt.proto, tt.size)
+		}
+		resp := response(t, conn.out.Bytes(), "GET")
+		got, err := io.ReadAll(resp.Body)
+		if err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%s with %d bytes: read %d bytes back, %v", tt.proto, tt.size, len(got), err)
+		}
+	}
+}
+
+func TestListingHTTP10(t *testing.T) {
+	enterRoot(t, nil)
+	if err := os.Mkdir("files", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("files/a.txt", []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := serve(t, "GET /files/ HTTP/1.0\r\nHost: localhost\r\n\r\n")
+	resp := response(t, raw, "GET")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte("a.txt")) {
+		t.Fatalf("listing got %d:\n%s", resp.StatusCode, raw)
+	}
+	if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) != 0 {
+		t.Errorf("HTTP/1.0 listing sent with Content-Length %d and Transfer-Encoding %v for %d bytes", resp.ContentLength, resp.TransferEncoding, len(body))
+	}
+}
+
+func TestVaryListsNegotiatedHeaders(t *testing.T) {
+	page := strings.Repeat("<p>bonjour</p>\n", 200)
+	enterRoot(t, map[string]string{"page.html": page, "page.fr.html": page, "data.bin": strings.Repeat("\x00\xff", 1000)})
+	*languages = "fr"
+	*healthPath = "/healthz"
+	defer func() {
+		*languages = ""
+		*healthPath = ""
+	}()
+
+	tests := []struct {
+		request string
+		vary    string
+	}{
+		{"GET /page.html HTTP/1.1\r\nHost: localhost\r\n\r\n", "Accept-Language, Accept-Encoding"},
+		{"GET /page.html HTTP/1.1\r\nHost: localhost\r\nAccept-Language: fr\r\nAccept-Encoding: gzip\r\n\r\n", "Accept-Language, Accept-Encoding"},
+		{"HEAD /page.html HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n", "Accept-Language, Accept-Encoding"},
+		{"GET /data.bin HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n", ""},
+		{"GET /healthz HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n", "Accept"},
+	}
+	for _, tt := range tests {
+		method, _, _ := strings.Cut(tt.request, " ")
+		resp := response(t, serve(t, tt.request), method)
+		if got := strings.Join(resp.Header.Values("Vary"), ", "); got != tt.vary {
+			t.Errorf("%q: Vary = %q, want %q", strings.SplitN(tt.request, "\r\n", 2)[0], got, tt.vary)
+		}
+
+		// A 304 for the same request names the same headers
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			continue
+		}
+		resp = response(t, serve(t, strings.Replace(tt.request, "\r\n\r\n", "\r\nIf-None-Match: "+etag+"\r\n\r\n", 1)), method)
+		if got := strings.Join(resp.Header.Values("Vary"), ", "); resp.StatusCode != http.StatusNotModified || got != tt.vary {
+			t.Errorf("%q revalidated: got %d with Vary %q, want 304 with %q", strings.SplitN(tt.request, "\r\n", 2)[0], resp.StatusCode, got, tt.vary)
+		}
+	}
+}
+
+func TestListingNotModified(t *testing.T) {
+	enterRoot(t, nil)
+	if err := os.Mkdir("files", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("files/a.txt", []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes("files/a.txt", past, past)
+	os.Chtimes("files", past, past)
+
+	get := func(ifModifiedSince string) *http.Response {
+		t.Helper()
+		raw := "GET /files/ HTTP/1.1\r\nHost: localhost\r\n"
+		if ifModifiedSince != "" {
+			raw += "If-Modified-Since: " + ifModifiedSince + "\r\n"
+		}
+		return response(t, serve(t, raw+"\r\n"), "GET")
+	}
+	first := get("")
+	lastModified := first.Header.Get("Last-Modified")
+	if first.StatusCode != http.StatusOK || lastModified != past.UTC().Format(http.TimeFormat) {
+		t.Fatalf("listing got %d with Last-Modified %q, want 200 with %s", first.StatusCode, lastModified, past.UTC().Format(http.TimeFormat))
+	}
+	if resp := get(lastModified); resp.StatusCode != http.StatusNotModified || resp.Header.Get("Last-Modified") != lastModified {
+		t.Errorf("unchanged listing got %d with Last-Modified %q, want 304 with %q", resp.StatusCode, resp.Header.Get("Last-Modified"), lastModified)
+	}
+
+	// Rewriting a listed file changes its size and time but not the directory's
+	later := past.Add(time.Minute)
+	if err := os.WriteFile("files/a.txt", []byte("longer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes("files/a.txt", later, later)
+	os.Chtimes("files", past, past)
+	if resp := get(lastModified); resp.StatusCode != http.StatusOK || resp.Header.Get("Last-Modified") != later.UTC().Format(http.TimeFormat) {
+		t.Errorf("listing after a file changed got %d with Last-Modified %q, want 200 with %s", resp.StatusCode, resp.Header.Get("Last-Modified"), later.UTC().Format(http.TimeFormat))
+	}
+
+	// Adding a file changes the directory's time
+	if err := os.WriteFile("files/b.txt", []byte("b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes("files/b.txt", past, past)
+	if resp := get(later.UTC().Format(http.TimeFormat)); resp.StatusCode != http.StatusOK {
+		t.Errorf("listing after a file was added got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestRangeFromCache(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	enterRoot(t, map[string]string{"data.txt": content})
+	fileCache = newContentCache(1 << 20)
+	defer func() { fileCache = nil }()
+	serve(t, "GET /data.txt HTTP/1.1\r\nHost: localhost\r\n\r\n") // fills the cache
+
+	// Same size and time on disk, other bytes: only the cache has the original
+	info, err := os.Stat("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("data.txt", []byte(strings.Repeat("-", len(content))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes("data.txt", info.ModTime(), info.ModTime())
+
+	tests := []struct {
+		rangeHeader, body, contentRange string
+	}{
+		{"bytes=0-3", "0123", "bytes 0-3/20"},
+		{"bytes=10-", "abcdefghij", "bytes 10-19/20"},
+		{"bytes=-4", "ghij", "bytes 16-19/20"},
+		{"bytes=5-5", "5", "bytes 5-5/20"},
+	}
+	for _, tt := range tests {
+		resp := response(t, serve(t, "GET /data.txt HTTP/1.1\r\nHost: localhost\r\nRange: "+tt.rangeHeader+"\r\n\r\n"), "GET")
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusPartialContent || string(body) != tt.body || resp.Header.Get("Content-Range") != tt.contentRange {
+			t.Errorf("Range %s: got %d %q with Content-Range %q, want 206 %q with %q",
+				tt.rangeHeader, resp.StatusCode, body, resp.Header.Get("Content-Range"), tt.body, tt.contentRange)
+		}
+	}
+	if cached := fileCache.get("data.txt", info); cached == nil || string(cached.body) != content {
+		t.Errorf("cache entry changed by serving ranges")
+	}
+}
+
+func TestErrorConnectionHeader(t *testing.T) {
+	enterRoot(t, nil)
+	*maxBodySize = 10
+	defer func() { *maxBodySize = 0 }()
+
+	tests := []struct {
+		name, request string
+		status        int
+		close         bool
+	}{
+		{"missing file", "GET /missing.txt HTTP/1.1\r\nHost: localhost\r\n\r\n", http.StatusNotFound, false},
+		{"malformed request", "NOT A REQUEST\r\n\r\n", http.StatusBadRequest, true},
+		{"declared body too large", "POST /up.txt HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100000\r\n\r\n", http.StatusRequestEntityTooLarge, true},
+		{"body cut off at the limit", "POST /up.txt HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n14\r\n01234567890123456789\r\n", http.StatusRequestEntityTooLarge, true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		sem := make(chan struct{}, 1)
+		sem <- struct{}{} // the slot handleConnection is handed
+		go handleConnection(server, sem)
+
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go io.WriteString(client, tt.request)
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		client.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.StatusCode != tt.status || resp.Close != tt.close {
+			t.Errorf("%s: got %d with Connection %q, want %d closing: %v", tt.name, resp.StatusCode, resp.Header.Get("Connection"), tt.status, tt.close)
+		}
+	}
+}
+
+// signHS256 builds an HS256 token for claims, signed with key
+func signHS256(alg, claims string, key []byte) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyBearer(t *testing.T) {
+	key := []byte("test secret")
+	jwtHMACKey = key
+	defer func() { jwtHMACKey = nil }()
+	now := time.Now().Unix()
+	tamper := func(token, claims string) string {
+		parts := strings.Split(token, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(claims))
+		return strings.Join(parts, ".")
+	}
+	unsigned := func(alg string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"`+alg+`"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + "."
+	}
+
+	tests := []struct {
+		name, authorization string
+		valid               bool
+	}{
+		{"valid", "Bearer " + signHS256("HS256", `{"sub":"alice"}`, key), true},
+		{"valid within its period", "Bearer " + signHS256("HS256", fmt.Sprintf(`{"nbf":%d,"exp":%d}`, now-60, now+60), key), true},
+		{"lower-case scheme", "bearer " + signHS256("HS256", `{}`, key), true},
+		{"no header", "", false},
+		{"basic scheme", "Basic YWxpY2U6c2VjcmV0", false},
+		{"bad signature", "Bearer " + signHS256("HS256", `{}`, []byte("other secret")), false},
+		{"tampered claims", "Bearer " + tamper(signHS256("HS256", `{"sub":"alice"}`, key), `{"sub":"root"}`), false},
+		{"alg none", "Bearer " + unsigned("none"), false},
+		{"alg mismatch", "Bearer " + signHS256("RS256", `{}`, key), false},
+		{"expired", "Bearer " + signHS256("HS256", fmt.Sprintf(`{"exp":%d}`, now-1), key), false},
+		{"not yet valid", "Bearer " + signHS256("HS256", fmt.Sprintf(`{"nbf":%d}`, now+60), key), false},
+		{"two segments", "Bearer " + strings.Join(strings.Split(signHS256("HS256", `{}`, key), ".")[:2], "."), false},
+		{"four segments", "Bearer " + signHS256("HS256", `{}`, key) + ".x", false},
+		{"bad base64", "Bearer !!!." + strings.SplitN(signHS256("HS256", `{}`, key), ".", 2)[1], false},
+	}
+	for _, tt := range tests {
+		req := &http.Request{Header: http.Header{}}
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		if err := verifyBearer(req); (err == nil) != tt.valid {
+			t.Errorf("%s: verifyBearer = %v, want valid: %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestApr1Hash(t *testing.T) {
+	// Generated with htpasswd -m (openssl passwd -apr1 gives the same)
+	const hash = "$apr1$rOHzgpmK$NwWDaUxaoVTufm43LLbkf/"
+	if got := apr1Hash("secret", "rOHzgpmK"); got != hash {
+		t.Errorf("apr1Hash = %q, want %q", got, hash)
+	}
+	if got := apr1Hash("Secret", "rOHzgpmK"); got == hash {
+		t.Errorf("apr1Hash of another password gave the same hash")
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	htpasswdUsers = map[string]string{
+		"alice": "$apr1$rOHzgpmK$NwWDaUxaoVTufm43LLbkf/",
+		"bob":   "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", // "secret"
+		"carol": "$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC",
+	}
+	defer func() { htpasswdUsers = nil }()
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", true},
+		{"bob", "wrong", false},
+		{"carol", "secret", false}, // bcrypt cannot be checked
+		{"mallory", "secret", false},
+	}
+	for _, tt := range tests {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(tt.user, tt.password)
+		if got := authorized(req); got != tt.want {
+			t.Errorf("authorized(%s:%s) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+	if authorized(&http.Request{Header: http.Header{}}) {
+		t.Errorf("a request without credentials was authorized")
+	}
+}
+
+func TestAccessLogNamesOnlyVerifiedUsers(t *testing.T) {
+	enterRoot(t, map[string]string{"page.html": "page\n"})
+	if err := os.Mkdir("private", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("private/page.html", []byte("private\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	accessLog = log.New(&logged, "", 0)
+	htpasswdUsers = map[string]string{"alice": "$apr1$rOHzgpmK$NwWDaUxaoVTufm43LLbkf/"}
+	*authPaths = "/private"
+	defer func() {
+		accessLog = nil
+		htpasswdUsers = nil
+		*authPaths = "/"
+	}()
+
+	tests := []struct {
+		path, credentials, user string
+	}{
+		{"/private/page.html", "alice:secret", "alice"},
+		{"/private/page.html", "alice:wrong", "-"},
+		{"/page.html", "admin:anything", "-"},
+	}
+	for _, tt := range tests {
+		logged.Reset()
+		serve(t, "GET "+tt.path+" HTTP/1.1\r\nHost: localhost\r\nAuthorization: Basic "+
+			base64.StdEncoding.EncodeToString([]byte(tt.credentials))+"\r\n\r\n")
+		if fields := strings.Fields(logged.String()); len(fields) < 3 || fields[2] != tt.user {
+			t.Errorf("GET %s as %s logged %q, want user %s", tt.path, tt.credentials, logged.String(), tt.user)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		urlPath, want string
+		ok            bool
+	}{
+		{"/", ".", true},
+		{"/a/b.txt", "a/b.txt", true},
+		{"/a/../b.txt", "b.txt", true},
+		{"//a//b.txt", "a/b.txt", true},
+		{"/..", "", false},
+		{"/../etc/passwd", "", false},
+		{"/a/../../etc/passwd", "", false},
+		{"/a/./../../b", "", false},
+	}
+	for _, tt := range tests {
+		got, err := resolvePath(tt.urlPath)
+		if (err == nil) != tt.ok || got != filepath.FromSlash(tt.want) {
+			t.Errorf("resolvePath(%q) = %q, %v; want %q, ok %v", tt.urlPath, got, err, tt.want, tt.ok)
+		}
+	}
+
+	// Percent-encoded dots are decoded before the path is resolved
+	enterRoot(t, map[string]string{"page.html": "page\n"})
+	for _, target := range []string{"/%2e%2e/etc/passwd", "/a/%2E%2E/%2e%2e/etc/passwd", "/..%2fetc/passwd"} {
+		resp := response(t, serve(t, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n"), "GET")
+		if resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s got %d, want 400 or 404", target, resp.StatusCode)
+		}
+	}
+}
+
+func TestInsideRoot(t *testing.T) {
+	base := t.TempDir()
+	for _, dir := range []string{"root/sub", "rootx", "alias", "outside"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"root/sub/a.txt", "rootx/b.txt", "outside/secret.txt"} {
+		if err := os.WriteFile(filepath.Join(base, file), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/escape":    "../outside",
+		"root/inner":     "sub",
+		"root/sibling":   "../rootx",
+		"alias/escape":   "../outside/secret.txt",
+		"alias/absolute": filepath.Join(base, "outside"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, link)); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+
+	root, alias := filepath.Join(base, "root"), filepath.Join(base, "alias")
+	tests := []struct {
+		root, path string
+		want       bool
+	}{
+		{root, "root/sub/a.txt", true},
+		{root, "root/sub/new/upload.txt", true}, // does not exist yet
+		{root, "root/inner/a.txt", true},
+		{root, "root", true},
+		{root, "root/escape/secret.txt", false},
+		{root, "root/escape/new.txt", false},
+		{root, "root/sibling/b.txt", false},
+		{root, "rootx/b.txt", false}, // shares the root's name as a prefix
+		{root, "root/../outside/secret.txt", false},
+		{alias, "alias/escape", false},
+		{alias, "alias/absolute/secret.txt", false},
+	}
+	for _, tt := range tests {
+		if got := insideRoot(tt.root, filepath.Join(base, tt.path)); got != tt.want {
+			t.Errorf("insideRoot(%s, %s) = %v, want %v", filepath.Base(tt.root), tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name, input, addr string
+		ok                bool
+	}{
+		{"TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", true},
+		{"TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", true},
+		{"UNKNOWN", "PROXY UNKNOWN\r\n", "", true},
+		{"UNKNOWN with addresses", "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", true},
+		{"107 bytes", "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535    65535\r\n", "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", true},
+		{"108 bytes", "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535     65535\r\n", "", false},
+		{"no line end", strings.Repeat("PROXY ", 30), "", false},
+		{"truncated", "PROXY TCP4 192.0.2.1 198.51", "", false},
+		{"bare LF", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", false},
+		{"missing header", "GET / HTTP/1.1\r\n", "", false},
+		{"empty", "", "", false},
+		{"bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n", "", false},
+		{"port not a number", "PROXY TCP4 192.0.2.1 198.51.100.1 http 443\r\n", "", false},
+		{"IPv6 address as TCP4", "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", "", false},
+		{"IPv4 address as TCP6", "PROXY TCP6 192.0.2.1 2001:db8::2 56324 443\r\n", "", false},
+		{"bad address", "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n", "", false},
+		{"missing field", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", false},
+		{"unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", false},
+	}
+	for _, tt := range tests {
+		reader := bufio.NewReader(strings.NewReader(tt.input + "GET / HTTP/1.1\r\n\r\n"))
+		if strings.HasPrefix(tt.name, "truncated") || tt.name == "empty" || tt.name == "no line end" {
+			reader = bufio.NewReader(strings.NewReader(tt.input))
+		}
+		addr, err := readProxyHeader(reader)
+		if (err == nil) != tt.ok || addr != tt.addr {
+			t.Errorf("%s: got %q, %v; want %q, ok %v", tt.name, addr, err, tt.addr, tt.ok)
+			continue
+		}
+		// The request after a valid header is left to be read
+		if tt.ok {
+			if rest, _ := reader.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%s: header read into the request, next line %q", tt.name, rest)
+			}
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	const size = 100
+	tests := []struct {
+		name, value   string
+		start, length int64
+		unsatisfiable bool
+		ok            bool
+	}{
+		{"closed", "bytes=10-19", 10, 10, false, true},
+		{"whole file", "bytes=0-99", 0, 100, false, true},
+		{"open-ended", "bytes=90-", 90, 10, false, true},
+		{"end past size", "bytes=90-500", 90, 10, false, true},
+		{"suffix", "bytes=-10", 90, 10, false, true},
+		{"suffix longer than file", "bytes=-500", 0, 100, false, true},
+		{"zero suffix", "bytes=-0", 0, 0, true, false},
+		{"start at size", "bytes=100-", 0, 0, true, false},
+		{"start past size", "bytes=150-200", 0, 0, true, false},
+		{"start after end", "bytes=20-10", 0, 0, false, false},
+		{"multiple ranges", "bytes=0-9,20-29", 0, 0, false, false},
+		{"other unit", "items=0-9", 0, 0, false, false},
+		{"no dash", "bytes=10", 0, 0, false, false},
+		{"negative start", "bytes=-10-20", 0, 0, false, false},
+		{"bad start", "bytes=a-9", 0, 0, false, false},
+		{"bad end", "bytes=0-b", 0, 0, false, false},
+	}
+	for _, tt := range tests {
+		start, length, err := parseRange(tt.value, size)
+		if (err == nil) != tt.ok || (err == errUnsatisfiableRange) != tt.unsatisfiable {
+			t.Errorf("%s: %q gave error %v", tt.name, tt.value, err)
+			continue
+		}
+		if start != tt.start || length != tt.length {
+			t.Errorf("%s: %q gave start %d length %d, want %d, %d", tt.name, tt.value, start, length, tt.start, tt.length)
+		}
+	}
+}
+
+// A Range starting past the end gets 416 with the real size
+func TestRangeNotSatisfiable(t *testing.T) {
+	enterRoot(t, map[string]string{"data.bin": "\x00\x01\x02\x03"})
+	res := response(t, serve(t, "GET /data.bin HTTP/1.1\r\nHost: x\r\nRange: bytes=4-\r\n\r\n"), "GET")
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("got status %d, want 416", res.StatusCode)
+	}
+	if got := res.Header.Get("Content-Range"); got != "bytes */4" {
+		t.Errorf("got Content-Range %q, want bytes */4", got)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	input := `# leading comment
+root = "/srv/www"   # trailing comment
+"quoted key" = "a \"quoted\" value"
+hash = "not # a comment"
+workers = 8
+gzip = true
+
+[mime]
+".md" = "text/markdown"
+`
+	entries, err := parseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configEntry{
+		{"", "root", "/srv/www", 2},
+		{"", "quoted key", `a "quoted" value`, 3},
+		{"", "hash", "not # a comment", 4},
+		{"", "workers", "8", 5},
+		{"", "gzip", "true", 6},
+		{"mime", ".md", "text/markdown", 9},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d: got %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{
+		"key",
+		"key = ",
+		`key = "unterminated`,
+		"key = value extra",
+		"key = [1, 2]",
+		"[mime",
+		"[]",
+		"key = 1\nkey = 2",
+	} {
+		if _, err := parseConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+// useFlags swaps in a flag set holding only the named string flags and a fresh
+// configSource, restoring both when the test ends
+func useFlags(tb testing.TB, args []string, names ...string) map[string]*string {
+	tb.Helper()
+	savedFlags, savedSource := flag.CommandLine, configSource
+	tb.Cleanup(func() { flag.CommandLine, configSource = savedFlags, savedSource })
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	configSource = make(map[string]string)
+	values := make(map[string]*string)
+	for _, name := range names {
+		values[name] = flag.String(name, "default", "")
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		tb.Fatal(err)
+	}
+	return values
+}
+
+// Flags beat the environment, which beats the config file
+func TestConfigPrecedence(t *testing.T) {
+	values := useFlags(t, []string{"-from-flag=flag"}, "from-flag", "from-env", "from-config", "unset")
+	t.Setenv("WEBSERVER_FROM_FLAG", "env")
+	t.Setenv("WEBSERVER_FROM_ENV", "env")
+	path := filepath.Join(t.TempDir(), "server.toml")
+	config := "from-flag = \"config\"\nfrom-env = \"config\"\nfrom-config = \"config\"\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	applyEnv()
+	if _, err := applyConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"from-flag": "flag", "from-env": "env", "from-config": "config", "unset": "default"} {
+		if *values[name] != want {
+			t.Errorf("-%s = %q, want %q", name, *values[name], want)
+		}
+		if source := configSource[name]; name != "unset" && source != want {
+			t.Errorf("-%s source %q, want %q", name, source, want)
+		}
+	}
+
+	// Keys that are not flags are rejected with their line
+	if err := os.WriteFile(path, []byte("from-config = \"x\"\nno-such-flag = 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfigFile(path); err == nil || !strings.Contains(err.Error(), ":2: unknown setting") {
+		t.Errorf("unknown key: got %v", err)
+	}
+}
+
+// The environment fills in only the flags missing from the command line
+func TestApplyEnv(t *testing.T) {
+	values := useFlags(t, []string{"-ip-quota=flag"}, "ip-quota", "read-timeout", "unset")
+	t.Setenv("WEBSERVER_IP_QUOTA", "env")
+	t.Setenv("WEBSERVER_READ_TIMEOUT", "env")
+	t.Setenv("WEBSERVER_read_timeout", "ignored")
+
+	applyEnv()
+	for name, want := range map[string]string{"ip-quota": "flag", "read-timeout": "env", "unset": "default"} {
+		if *values[name] != want {
+			t.Errorf("-%s = %q, want %q", name, *values[name], want)
+		}
+	}
+	if configSource["ip-quota"] != "flag" || configSource["read-timeout"] != "env" || configSource["unset"] != "" {
+		t.Errorf("got sources %v", configSource)
+	}
+}
+
+// Closing the HTTP/2 listener ends Serve instead of leaving it blocked in Accept
+func TestConnListenerClose(t *testing.T) {
+	l := newConnListener()
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	server.Close()
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("Serve returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Errorf("Accept after Close returned %v, want net.ErrClosed", err)
+	}
+	client, other := net.Pipe()
+	defer client.Close()
+	defer other.Close()
+	if l.push(client) {
+		t.Error("push succeeded on a closed listener")
+	}
+}
+
+// A HEAD gets exactly the headers of the GET, whichever way the body is framed
+func TestHeadMatchesGet(t *testing.T) {
+	// Hex of a long pseudo-random sequence still compresses past maxBufferedBody
+	var big strings.Builder
+	for x := uint32(1); big.Len() < 4*maxBufferedBody; x = x*1664525 + 1013904223 {
+		fmt.Fprintf(&big, "%08x\n", x)
+	}
+	enterRoot(t, map[string]string{
+		"small.txt":      strings.Repeat("hello, world\n", 200),
+		"big.txt":        big.String(),
+		"sidecar.txt":    strings.Repeat("plain\n", 300),
+		"sidecar.txt.gz": "\x1f\x8b precompressed",
+	})
+	defer func(enabled bool) { *precompressed = enabled }(*precompressed)
+	*precompressed = true
+
+	for _, tt := range []struct{ path, framing string }{
+		{"/small.txt", "Content-Length"},
+		{"/big.txt", "Transfer-Encoding"},
+		{"/sidecar.txt.gz", "Content-Length"},
+		{"/sidecar.txt", "Content-Length"},
+	} {
+		request := " " + tt.path + " HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"
+		get := serve(t, "GET"+request)
+		head := serve(t, "HEAD"+request)
+		getHeaders, _, _ := bytes.Cut(get, []byte("\r\n\r\n"))
+		headHeaders, rest, _ := bytes.Cut(head, []byte("\r\n\r\n"))
+		if !bytes.Equal(headHeaders, getHeaders) {
+			t.Errorf("%s: HEAD headers\n%s\ndiffer from GET headers\n%s", tt.path, headHeaders, getHeaders)
+		}
+		if len(rest) != 0 {
+			t.Errorf("%s: HEAD sent %d body bytes", tt.path, len(rest))
+		}
+		if !bytes.Contains(getHeaders, []byte("\r\n"+tt.framing+": ")) {
+			t.Errorf("%s: GET headers lack %s:\n%s", tt.path, tt.framing, getHeaders)
+		}
+	}
+}
@@ -1,69 +1,274 @@
+// The proxy is built on its own (go build proxy.go), so it cannot share code
+// with http_server.go. These helpers are copied from the server, minus its
+// log levels and server-only fields, and must be kept in step with it by
+// hand: validNetwork, acceptBackoff, countingConn, connectionHeader,
+// closeAfterResponse, hostOnly and writeStatusLine. The proxy's
+// sendErrorResponse is its own.
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Command line flags
+var (
+	network          = flag.String("network", "tcp", "network to listen on: tcp, tcp4 or tcp6")
+	contentFilter    = flag.String("content-filter", "", "file of blocked words, one per line; HTML responses containing one are replaced by a block page")
+	statsHost        = flag.String("stats-host", "", "host name whose /stats path returns the proxy's statistics instead of being proxied, e.g. proxy.local (empty disables it)")
+	poolSize         = flag.Int("pool-size", 0, "idle keep-alive connections kept per upstream host:port (0 opens a new connection for every request)")
+	poolIdle         = flag.Duration("pool-idle-timeout", 90*time.Second, "how long a pooled upstream connection may sit idle before it is closed")
+	filterMaxSize    = flag.Int64("filter-max-size", 1<<20, "largest HTML body scanned by -content-filter, bigger responses pass through unscanned")
+	tlsCert          = flag.String("tls-cert", "", "PEM certificate chain; with -tls-key clients reach the proxy over TLS")
+	tlsKey           = flag.String("tls-key", "", "PEM private key for -tls-cert")
+	clientCA         = flag.String("client-ca", "", "PEM bundle of CAs whose client certificates are verified and forwarded as X-Client-Cert-Subject (requires -tls-cert)")
+	keepAliveTimeout = flag.Duration("keepalive-timeout", 0, "how long a client connection may wait for its next request (0 closes it after one request)")
+)
+
+// viaHeader identifies the proxy on responses it generates itself
+const viaHeader = "1.1 lab1-proxy"
+
+// stats holds the proxy's counters for the -stats-host page
+var stats = proxyStats{upstreams: make(map[string]int64)}
+
+// proxyStats counts proxied requests, traffic and requests per upstream host
+type proxyStats struct {
+	requests          atomic.Int64
+	bytesIn           atomic.Int64 // read from origin servers
+	bytesOut          atomic.Int64 // written to clients
+	activeConnections atomic.Int64
+
+	mu        sync.Mutex
+	upstreams map[string]int64
+}
+
+// pool holds idle upstream connections when -pool-size is set
+var pool = connPool{idle: make(map[string][]*upstreamConn)}
+
+// blockedWords holds the lower-cased -content-filter words, empty when filtering is off
+var blockedWords [][]byte
+
 func main() {
-	// step 1: Check and get command line argument (port)
-	if len(os.Args) != 2 {
-		log.Fatalf("Usage: %s <port>", os.Args[0])
+	// step 1: Check and get command line arguments (flags and port)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("Usage: %s [flags] <port>", os.Args[0])
 	}
-	port := os.Args[1]
+	port := flag.Arg(0)
 	if _, err := strconv.Atoi(port); err != nil {
 		log.Fatalf("Invalid port: %s", port)
 	}
+	if !validNetwork(*network) {
+		log.Fatalf("Invalid network %q: must be tcp, tcp4 or tcp6", *network)
+	}
+
+	if *contentFilter != "" {
+		words, err := loadBlockedWords(*contentFilter)
+		if err != nil {
+			log.Fatalf("Failed to load content filter %s: %v", *contentFilter, err)
+		}
+		blockedWords = words
+		log.Printf("Content filter loaded %d blocked words from %s", len(blockedWords), *contentFilter)
+	}
+
+	if *keepAliveTimeout < 0 {
+		log.Fatalf("Invalid -keepalive-timeout %v: must not be negative", *keepAliveTimeout)
+	}
+
+	if *poolSize > 0 {
+		if *poolIdle <= 0 {
+			log.Fatalf("Invalid -pool-idle-timeout %v: must be positive", *poolIdle)
+		}
+		go pool.reapIdle()
+	}
 
 	address := ":" + port
 	log.Printf("Proxy will start on %s...", address)
 	// step 2: Listen on the port
-	listener, err := net.Listen("tcp", address)
+	listener, err := net.Listen(*network, address)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 	defer listener.Close()
 
+	// Over TLS the origin learns the scheme and the verified client certificate
+	if *tlsCert != "" || *tlsKey != "" {
+		config, err := proxyTLSConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		listener = tls.NewListener(listener, config)
+		log.Printf("Proxy accepts TLS connections only")
+	} else if *clientCA != "" {
+		log.Fatalf("-client-ca requires -tls-cert and -tls-key")
+	}
+
 	// step 3: Accept connections loop
+	var backoff acceptBackoff
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if isTemporaryAcceptError(err) {
+				backoff.wait(err)
+				continue
+			}
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
+		backoff.reset()
 
 		// step 4: Start a goroutine for each connection
 		go handleProxyRequest(conn)
 	}
 }
 
+// proxyTLSConfig loads the certificate for the TLS listener and, if caFile is
+// set, asks clients for a certificate signed by one of its CAs
+func proxyTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// validNetwork reports whether a -network value can be passed to net.Listen
+func validNetwork(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6"
+}
+
+// Accept backoff limits used when the process runs out of file descriptors
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// acceptBackoff throttles the accept loop while Accept keeps failing with temporary errors
+type acceptBackoff struct {
+	delay  time.Duration
+	errors int
+}
+
+// wait sleeps after a temporary accept error, doubling the delay each time.
+// Only the first error of an episode is logged.
+func (b *acceptBackoff) wait(err error) {
+	if b.delay == 0 {
+		b.delay = minAcceptBackoff
+		log.Printf("Temporary error accepting connections, backing off: %v", err)
+	} else {
+		b.delay = min(b.delay*2, maxAcceptBackoff)
+	}
+	b.errors++
+	time.Sleep(b.delay)
+}
+
+// reset ends a backoff episode after a successful accept
+func (b *acceptBackoff) reset() {
+	if b.errors > 0 {
+		log.Printf("Accepting connections again after %d temporary errors", b.errors)
+	}
+	b.delay = 0
+	b.errors = 0
+}
+
+// isTemporaryAcceptError reports whether an Accept error is worth retrying after a pause,
+// such as running out of file descriptors: EMFILE and ENFILE report themselves
+// as temporary, and naming them would not build on Plan 9
+func isTemporaryAcceptError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
 func handleProxyRequest(clientConn net.Conn) {
 	defer clientConn.Close()
 	log.Printf("Handling new proxy connection: %s", clientConn.RemoteAddr().String())
 
+	// Count what is sent back to the client for the statistics page
+	counter := &countingConn{Conn: clientConn}
+	clientConn = counter
+	stats.activeConnections.Add(1)
+	defer func() {
+		stats.activeConnections.Add(-1)
+		stats.bytesOut.Add(counter.written)
+	}()
+
 	reader := bufio.NewReader(clientConn)
+	for requests := 0; ; requests++ {
+		// A kept-alive connection gets -keepalive-timeout for its next request
+		if requests > 0 {
+			clientConn.SetReadDeadline(time.Now().Add(*keepAliveTimeout))
+		}
 
-	// step 1: Parse request
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		log.Printf("Failed to parse request: %v", err)
-		if err != io.EOF && !strings.Contains(err.Error(), "connection reset") {
-			sendErrorResponse(clientConn, http.StatusBadRequest, "Bad Request")
+		// step 1: Parse request
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if requests > 0 && (err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded)) {
+				return // the client is done with the connection
+			}
+			log.Printf("Failed to parse request: %v", err)
+			counter.keepAlive = false // the stream cannot be trusted after malformed input
+			if err != io.EOF && !strings.Contains(err.Error(), "connection reset") {
+				sendErrorResponse(clientConn, http.StatusBadRequest, "")
+			}
+			return
+		}
+		clientConn.SetReadDeadline(time.Time{})
+		// Only GET bodies are forwarded; any other body would be left unread
+		// and taken for the next request
+		counter.keepAlive = *keepAliveTimeout > 0 && !req.Close && (req.ContentLength == 0 || req.Method == "GET")
+
+		serveProxyRequest(clientConn, req)
+		if !counter.keepAlive {
+			return
 		}
+	}
+}
+
+// serveProxyRequest answers one request read from a client connection
+func serveProxyRequest(clientConn net.Conn, req *http.Request) {
+	// Requests for the statistics host are answered by the proxy itself
+	if *statsHost != "" && req.URL.Path == "/stats" && hostOnly(req.Host) == *statsHost {
+		serveStats(clientConn)
 		return
 	}
 
 	// step 2: Only implement GET method
 	if req.Method != "GET" {
 		log.Printf("Unsupported method: %s", req.Method)
-		sendErrorResponse(clientConn, http.StatusNotImplemented, "Not Implemented")
+		sendErrorResponse(clientConn, http.StatusNotImplemented, "")
 		return
 	}
 
@@ -81,7 +286,7 @@ func forwardRequest(clientConn net.Conn, req *http.Request) {
 		targetHost = req.Host
 	}
 	if targetHost == "" {
-		sendErrorResponse(clientConn, http.StatusBadRequest, "Bad Request: Missing host in request")
+		sendErrorResponse(clientConn, http.StatusBadRequest, "Missing host in request")
 		return
 	}
 
@@ -91,14 +296,23 @@ func forwardRequest(clientConn net.Conn, req *http.Request) {
 		targetHost = net.JoinHostPort(targetHost, "80")
 	}
 
-	// step 3: Connect to target server
-	remoteConn, err := net.Dial("tcp", targetHost)
+	// step 3: Connect to target server, reusing an idle pooled connection if there is one
+	remote, err := pool.get(targetHost)
 	if err != nil {
 		log.Printf("Failed to connect to target server %s: %v", targetHost, err)
-		sendErrorResponse(clientConn, http.StatusBadGateway, "Bad Gateway: Could not connect to host")
+		closeAfterResponse(clientConn)
+		sendErrorResponse(clientConn, http.StatusBadGateway, "Could not connect to host")
 		return
 	}
-	defer remoteConn.Close()
+	reusable := false
+	defer func() {
+		if reusable {
+			pool.put(targetHost, remote)
+		} else {
+			remote.Close()
+		}
+	}()
+	stats.recordRequest(targetHost)
 
 	// step 4: Forward client request to target server
 
@@ -106,32 +320,424 @@ func forwardRequest(clientConn net.Conn, req *http.Request) {
 
 	// Remove proxy-specific headers
 	req.Header.Del("Proxy-Connection")
-	req.Header.Set("Connection", "close") // Force close connection to simplify handling
+	if *poolSize > 0 {
+		req.Header.Del("Connection") // HTTP/1.1 keeps the upstream connection open by default
+	} else {
+		req.Header.Set("Connection", "close") // Force close connection to simplify handling
+	}
+
+	// Tell the origin how the client originally reached us
+	setForwardedHeaders(req, clientConn)
+
+	// The filter scans plain text, so ask the origin not to compress
+	if len(blockedWords) > 0 {
+		req.Header.Del("Accept-Encoding")
+	}
 
-	if err := req.Write(remoteConn); err != nil {
-		log.Printf("Failed to forward request to %s: %v", targetHost, err)
-		sendErrorResponse(clientConn, http.StatusBadGateway, "Bad Gateway: Error writing to remote")
+	// step 5: Without pooling or filtering, copy the target server's response *as is* back to the client
+	// io.Copy copies status line, all headers, and body. Its end is only
+	// known from the origin closing, so the client connection closes too
+	if *poolSize == 0 && len(blockedWords) == 0 {
+		closeAfterResponse(clientConn)
+		start := remote.read
+		defer func() { stats.bytesIn.Add(remote.read - start) }()
+		if err := req.Write(remote); err != nil {
+			log.Printf("Failed to forward request to %s: %v", targetHost, err)
+			sendErrorResponse(clientConn, http.StatusBadGateway, "Error writing to remote")
+			return
+		}
+		bytesCopied, err := io.Copy(clientConn, remote.countingConn)
+		if err != nil {
+			log.Printf("Failed to copy response from %s: %v", targetHost, err)
+		}
+		log.Printf("Copied %d bytes of response from %s", bytesCopied, targetHost)
 		return
 	}
 
-	// step 5: Copy the target server's response *as is* back to the client
-	// io.Copy copies status line, all headers, and body
-	bytesCopied, err := io.Copy(clientConn, remoteConn)
+	// step 6: Otherwise the response is parsed, so its framing is known. A pooled
+	// connection the origin has closed in the meantime gets one retry on a new one
+	resp, err := remote.roundTrip(req)
+	if err != nil && remote.reused {
+		log.Printf("Pooled connection to %s failed, redialing: %v", targetHost, err)
+		remote.Close()
+		if remote, err = dialUpstream(targetHost); err == nil {
+			resp, err = remote.roundTrip(req)
+		}
+	}
 	if err != nil {
+		log.Printf("Failed to read response from %s: %v", targetHost, err)
+		closeAfterResponse(clientConn)
+		sendErrorResponse(clientConn, http.StatusBadGateway, "Invalid response from remote")
+		return
+	}
+	defer resp.Body.Close()
+
+	// step 7: Relay it, and only pool the connection once the whole body was read cleanly.
+	// The origin's Connection header is about the upstream connection, the
+	// client's is decided here; a body without framing ends with the connection
+	upstreamKeepAlive := !resp.Close
+	resp.Header.Del("Connection")
+	resp.Header.Del("Keep-Alive")
+	if resp.ContentLength < 0 && !slices.Contains(resp.TransferEncoding, "chunked") {
+		closeAfterResponse(clientConn)
+	}
+	resp.Close = connectionHeader(clientConn) == "close"
+	if !resp.Close {
+		resp.Header.Set("Connection", "keep-alive") // HTTP/1.0 clients need it spelled out
+	}
+	if err := relayResponse(clientConn, resp, req, targetHost); err != nil {
+		if err != errBlocked {
+			closeAfterResponse(clientConn)
+		}
+		return
+	}
+	reusable = upstreamKeepAlive && *poolSize > 0
+}
+
+// upstreamConn is a connection to an origin server together with its
+// buffered reader, which has to travel with it in the pool
+type upstreamConn struct {
+	*countingConn
+	reader    *bufio.Reader
+	reused    bool
+	idleSince time.Time
+}
+
+// dialUpstream opens a new connection to an origin server
+func dialUpstream(targetHost string) (*upstreamConn, error) {
+	conn, err := net.Dial("tcp", targetHost)
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingConn{Conn: conn}
+	return &upstreamConn{countingConn: counter, reader: bufio.NewReader(counter)}, nil
+}
+
+// roundTrip sends a request and reads the response headers, counting what
+// was read from the origin for the statistics page
+func (c *upstreamConn) roundTrip(req *http.Request) (*http.Response, error) {
+	start := c.read
+	defer func() { stats.bytesIn.Add(c.read - start) }()
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, conn: c}
+	return resp, nil
+}
+
+// countingBody adds the bytes read through a response body to the statistics
+type countingBody struct {
+	io.ReadCloser
+	conn *upstreamConn
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	start := b.conn.read
+	n, err := b.ReadCloser.Read(p)
+	stats.bytesIn.Add(b.conn.read - start)
+	return n, err
+}
+
+// connPool keeps idle keep-alive connections per upstream host:port
+type connPool struct {
+	mu   sync.Mutex
+	idle map[string][]*upstreamConn
+}
+
+// get returns the most recently used idle connection to targetHost, or dials a new one
+func (p *connPool) get(targetHost string) (*upstreamConn, error) {
+	p.mu.Lock()
+	for conns := p.idle[targetHost]; len(conns) > 0; conns = p.idle[targetHost] {
+		conn := conns[len(conns)-1]
+		p.idle[targetHost] = conns[:len(conns)-1]
+		if time.Since(conn.idleSince) < *poolIdle {
+			p.mu.Unlock()
+			conn.reused = true
+			return conn, nil
+		}
+		conn.Close()
+	}
+	delete(p.idle, targetHost)
+	p.mu.Unlock()
+	return dialUpstream(targetHost)
+}
+
+// put returns a connection to the pool, closing it when the host already has -pool-size idle ones
+func (p *connPool) put(targetHost string, conn *upstreamConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[targetHost]) >= *poolSize || conn.reader.Buffered() > 0 {
+		conn.Close()
+		return
+	}
+	conn.idleSince = time.Now()
+	p.idle[targetHost] = append(p.idle[targetHost], conn)
+}
+
+// reapIdle closes pooled connections that have been idle longer than -pool-idle-timeout
+func (p *connPool) reapIdle() {
+	for range time.Tick(*poolIdle / 2) {
+		p.mu.Lock()
+		for host, conns := range p.idle {
+			fresh := conns[:0]
+			for _, conn := range conns {
+				if time.Since(conn.idleSince) < *poolIdle {
+					fresh = append(fresh, conn)
+				} else {
+					conn.Close()
+				}
+			}
+			if len(fresh) == 0 {
+				delete(p.idle, host)
+			} else {
+				p.idle[host] = fresh
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// recordRequest counts a request proxied to an upstream host:port
+func (s *proxyStats) recordRequest(upstream string) {
+	s.requests.Add(1)
+	s.mu.Lock()
+	s.upstreams[upstream]++
+	s.mu.Unlock()
+}
+
+// statsReport is the JSON statistics payload
+type statsReport struct {
+	Requests          int64            `json:"requests_proxied"`
+	BytesIn           int64            `json:"bytes_in"`
+	BytesOut          int64            `json:"bytes_out"`
+	ActiveConnections int64            `json:"active_connections"`
+	Upstreams         map[string]int64 `json:"requests_per_upstream"`
+}
+
+// serveStats answers a request for the statistics page
+func serveStats(conn net.Conn) {
+	report := statsReport{
+		Requests:          stats.requests.Load(),
+		BytesIn:           stats.bytesIn.Load(),
+		BytesOut:          stats.bytesOut.Load(),
+		ActiveConnections: stats.activeConnections.Load(),
+		Upstreams:         make(map[string]int64),
+	}
+	stats.mu.Lock()
+	for host, count := range stats.upstreams {
+		report.Upstreams[host] = count
+	}
+	stats.mu.Unlock()
+	body, _ := json.MarshalIndent(report, "", "  ")
+
+	writeStatusLine(conn, http.StatusOK)
+	fmt.Fprintf(conn, "Content-Type: application/json\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Cache-Control: no-store\r\n")
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	conn.Write(body)
+}
+
+// countingConn wraps a connection and counts the bytes read from and written to it
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+
+	// keepAlive is set on a client connection while it may serve another request
+	keepAlive bool
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// ReadFrom lets io.Copy into the connection use the TCP connection's own
+// ReadFrom, which the embedded net.Conn does not expose
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	if readerFrom, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err := readerFrom.ReadFrom(r)
+		c.written += n
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{c}, r)
+}
+
+// connectionHeader is the Connection header value for a response written to
+// a client connection, keep-alive when another request may follow
+func connectionHeader(conn net.Conn) string {
+	if c, ok := conn.(*countingConn); ok && c.keepAlive {
+		return "keep-alive"
+	}
+	return "close"
+}
+
+// closeAfterResponse closes a client connection once the current response is
+// done: after errors that leave the connection in an unknown state, and for
+// responses whose end the client can only detect by the connection closing
+func closeAfterResponse(conn net.Conn) {
+	if c, ok := conn.(*countingConn); ok {
+		c.keepAlive = false
+	}
+}
+
+// hostOnly strips the port from a "host:port" address
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// errBlocked reports a response replaced by the content filter's block page
+var errBlocked = errors.New("response blocked by content filter")
+
+// relayResponse sends a parsed origin response on to the client. With a
+// content filter, HTML that contains a blocked word is replaced with a block
+// page. It returns nil only when the whole body was relayed
+func relayResponse(clientConn net.Conn, resp *http.Response, req *http.Request, targetHost string) error {
+	// step 1: Scan HTML bodies up to the size cap, everything else passes through
+	if len(blockedWords) > 0 && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") && resp.ContentLength <= *filterMaxSize {
+		scanned, err := io.ReadAll(io.LimitReader(resp.Body, *filterMaxSize+1))
+		if err != nil {
+			log.Printf("Failed to read response body from %s: %v", targetHost, err)
+			closeAfterResponse(clientConn)
+			sendErrorResponse(clientConn, http.StatusBadGateway, "Error reading from remote")
+			return err
+		}
+		if int64(len(scanned)) <= *filterMaxSize {
+			if word := findBlockedWord(scanned); word != "" {
+				log.Printf("Blocked %s: contains %q", req.URL.String(), word)
+				sendBlockPage(clientConn, req.URL.String())
+				return errBlocked
+			}
+		} else {
+			log.Printf("Response from %s is larger than %d bytes, not scanned", targetHost, *filterMaxSize)
+		}
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(scanned), resp.Body))
+	}
+
+	// step 2: Send the response on to the client
+	if err := resp.Write(clientConn); err != nil {
 		log.Printf("Failed to copy response from %s: %v", targetHost, err)
+		return err
+	}
+	return nil
+}
+
+// loadBlockedWords reads one word per line, ignoring blank lines and # comments
+func loadBlockedWords(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var words [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, []byte(strings.ToLower(line)))
+	}
+	return words, nil
+}
+
+// findBlockedWord returns the first blocked word found in body, case-insensitively
+func findBlockedWord(body []byte) string {
+	lower := bytes.ToLower(body)
+	for _, word := range blockedWords {
+		if bytes.Contains(lower, word) {
+			return string(word)
+		}
 	}
-	log.Printf("Copied %d bytes of response from %s", bytesCopied, targetHost)
+	return ""
 }
 
-// sendErrorResponse is a helper function to send error responses (same as server version)
-func sendErrorResponse(conn net.Conn, code int, status string) {
-	body := fmt.Sprintf("%d %s", code, status)
+// sendBlockPage replaces a filtered response with a 403 block page
+func sendBlockPage(conn net.Conn, target string) {
+	body := fmt.Sprintf("<html><body><h1>403 Forbidden</h1><p>%s was blocked by the content filter.</p></body></html>",
+		html.EscapeString(target))
+
+	writeStatusLine(conn, http.StatusForbidden)
+	fmt.Fprintf(conn, "Via: %s\r\n", viaHeader)
+	fmt.Fprintf(conn, "Content-Type: text/html\r\n")
+	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
+	fmt.Fprintf(conn, "\r\n") // End of headers
+	fmt.Fprintf(conn, "%s", body)
+}
+
+// setForwardedHeaders adds X-Forwarded-Proto/Host/Port describing the client's
+// connection to the proxy, and X-Client-Cert-Subject for a verified client certificate
+func setForwardedHeaders(req *http.Request, clientConn net.Conn) {
+	// The scheme is that of the client's connection to the proxy
+	proto := "http"
+	if counter, ok := clientConn.(*countingConn); ok {
+		clientConn = counter.Conn
+	}
+	// Only a certificate the proxy verified is forwarded, never one the client claims
+	req.Header.Del("X-Client-Cert-Subject")
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		proto = "https"
+		if state := tlsConn.ConnectionState(); len(state.VerifiedChains) > 0 {
+			req.Header.Set("X-Client-Cert-Subject", certSubject(state.PeerCertificates[0]))
+		}
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	if _, port, err := net.SplitHostPort(clientConn.LocalAddr().String()); err == nil {
+		req.Header.Set("X-Forwarded-Port", port)
+	}
+}
+
+// certSubject is a certificate's subject as a header value, keeping only
+// printable ASCII so a crafted subject cannot break the header
+func certSubject(cert *x509.Certificate) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, cert.Subject.String())
+}
+
+// writeStatusLine writes the status line; the reason phrase always comes from
+// http.StatusText, descriptive text belongs in the body
+func writeStatusLine(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+}
+
+// sendErrorResponse is a helper function to send error responses, with an
+// optional detail message appended to the body. Unlike the server version the
+// response is marked with Via and X-Proxy-Error so it cannot be mistaken for an
+// error relayed from the origin.
+func sendErrorResponse(conn net.Conn, code int, detail string) {
+	body := fmt.Sprintf("%d %s (proxy error)", code, http.StatusText(code))
+	if detail != "" {
+		body += ": " + detail
+	}
 	log.Printf("Sending error: %s", body)
 
-	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", code, status)
+	writeStatusLine(conn, code)
+	fmt.Fprintf(conn, "Via: %s\r\n", viaHeader)
+	fmt.Fprintf(conn, "X-Proxy-Error: true\r\n")
 	fmt.Fprintf(conn, "Content-Type: text/plain\r\n")
 	fmt.Fprintf(conn, "Content-Length: %d\r\n", len(body))
-	fmt.Fprintf(conn, "Connection: close\r\n")
+	fmt.Fprintf(conn, "Connection: %s\r\n", connectionHeader(conn))
 	fmt.Fprintf(conn, "\r\n") // End of headers
 	fmt.Fprintf(conn, "%s", body)
-}
\ No newline at end of file
+}